@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/markpash/heybabe/probe"
+	"github.com/peterbourgon/ff/v4"
+)
+
+// maxProbeRequestSize bounds the body of a probe request.
+const maxProbeRequestSize = 1 << 20
+
+// Limits of a probe request, so that one request can't take all the memory
+// or goroutines of the server.
+const (
+	maxProbeTargets     = 100
+	maxProbeFuzzHellos  = 100
+	maxProbeIPs         = 16
+	maxProbeRepeat      = 100
+	maxProbeConcurrency = 64
+	maxProbeTimeout     = 60 * time.Second
+	maxProbeDelay       = 60 * time.Second
+)
+
+// probeTarget is a target in a probe request.
+type probeTarget struct {
+	SNI  string `json:"sni"`
+	Host string `json:"host"`
+	IP   string `json:"ip"`
+	Port uint16 `json:"port"`
+}
+
+// probeRequest is the body of POST /v1/probe. It mirrors the command line
+// flags, and fields left out or zero take the same defaults.
+type probeRequest struct {
+	Targets          []probeTarget `json:"targets"`
+	Tests            []string      `json:"tests"`
+	Fingerprints     []string      `json:"fingerprints"`
+	FuzzHellos       []string      `json:"fuzz_hellos"`
+	SkipTests        []string      `json:"skip_tests"`
+	Resolver         string        `json:"resolver"`
+	PoisonCheck      bool          `json:"poison_check"`
+	TrustedResolvers []string      `json:"trusted_resolvers"`
+	IPv4             bool          `json:"ipv4"`
+	IPv6             bool          `json:"ipv6"`
+	AllIPs           bool          `json:"all_ips"`
+	MaxIPs           uint          `json:"max_ips"`
+	Repeat           uint          `json:"repeat"`
+	Concurrency      uint          `json:"concurrency"`
+	Delay            string        `json:"delay"`
+	Jitter           string        `json:"jitter"`
+	Timeout          string        `json:"timeout"`
+	Interleave       bool          `json:"interleave"`
+	Insecure         bool          `json:"insecure"`
+	Proxy            string        `json:"proxy"`
+	SourceIP         string        `json:"source_ip"`
+	Interface        string        `json:"interface"`
+	// ECHConfig is a base64 ECHConfigList, as in the ech= parameter of an
+	// HTTPS record.
+	ECHConfig string `json:"ech_config"`
+}
+
+// checkLimits rejects requests above the limits of the server.
+func (req probeRequest) checkLimits() error {
+	switch {
+	case len(req.Targets) > maxProbeTargets:
+		return fmt.Errorf("at most %d targets are allowed", maxProbeTargets)
+	case len(req.FuzzHellos) > maxProbeFuzzHellos:
+		return fmt.Errorf("at most %d fuzz_hellos are allowed", maxProbeFuzzHellos)
+	case req.MaxIPs > maxProbeIPs:
+		return fmt.Errorf("max_ips must be at most %d", maxProbeIPs)
+	case req.Repeat > maxProbeRepeat:
+		return fmt.Errorf("repeat must be at most %d", maxProbeRepeat)
+	case req.Concurrency > maxProbeConcurrency:
+		return fmt.Errorf("concurrency must be at most %d", maxProbeConcurrency)
+	}
+	return nil
+}
+
+// testOptions turns the request into options for probe.Run.
+func (req probeRequest) testOptions() (probe.Options, error) {
+	if err := req.checkLimits(); err != nil {
+		return probe.Options{}, err
+	}
+	to := probe.DefaultOptions()
+	to.PoisonCheck = req.PoisonCheck
+	to.AllIPs = req.AllIPs
+	to.MaxIPs = req.MaxIPs
+	if to.AllIPs && to.MaxIPs == 0 {
+		to.MaxIPs = maxProbeIPs
+	}
+	to.Interleave = req.Interleave
+	to.Insecure = req.Insecure
+	if req.IPv4 != req.IPv6 {
+		to.ResolveIPv4, to.ResolveIPv6 = req.IPv4, req.IPv6
+	}
+	var err error
+	if to.Source, err = probe.NewSourceBinding(req.SourceIP, req.Interface); err != nil {
+		return probe.Options{}, err
+	}
+	if to.ResolveIPv4, to.ResolveIPv6, err = to.Source.Families(to.ResolveIPv4, to.ResolveIPv6); err != nil {
+		return probe.Options{}, err
+	}
+	if req.Repeat != 0 {
+		to.Repeat = req.Repeat
+	}
+	if req.Concurrency != 0 {
+		to.Concurrency = req.Concurrency
+	}
+
+	for _, d := range []struct {
+		name  string
+		value string
+		dst   *time.Duration
+		max   time.Duration
+	}{
+		{"delay", req.Delay, &to.Delay, maxProbeDelay},
+		{"jitter", req.Jitter, &to.Jitter, maxProbeDelay},
+		{"timeout", req.Timeout, &to.Timeout, maxProbeTimeout},
+	} {
+		if d.value == "" {
+			continue
+		}
+		if *d.dst, err = time.ParseDuration(d.value); err != nil {
+			return probe.Options{}, fmt.Errorf("invalid %s: %w", d.name, err)
+		}
+		if *d.dst > d.max {
+			return probe.Options{}, fmt.Errorf("%s must be at most %s", d.name, d.max)
+		}
+	}
+
+	for _, pt := range req.Targets {
+		t := probe.Target{SNI: pt.SNI, Host: pt.Host, ManualIP: netip.IPv4Unspecified(), Port: pt.Port}
+		if t.SNI == "" {
+			return probe.Options{}, errors.New("target without sni")
+		}
+		if t.Host == "" {
+			t.Host = t.SNI
+		}
+		if t.Port == 0 {
+			t.Port = 443
+		}
+		if pt.IP != "" {
+			addr, err := netip.ParseAddr(pt.IP)
+			if err != nil {
+				return probe.Options{}, fmt.Errorf("invalid ip of target %s: %w", t.SNI, err)
+			}
+			t.ManualIP = addr.Unmap()
+		}
+		to.Targets = append(to.Targets, t)
+	}
+
+	suite := probe.Suite()
+	if len(req.Fingerprints) > 0 {
+		fingerprintTests, err := probe.FingerprintTests(req.Fingerprints)
+		if err != nil {
+			return probe.Options{}, err
+		}
+		suite = append(suite, fingerprintTests...)
+	}
+	for _, id := range req.FuzzHellos {
+		h, err := probe.ParseFuzzHello(id)
+		if err != nil {
+			return probe.Options{}, err
+		}
+		spec, err := h.Spec()
+		if err != nil {
+			return probe.Options{}, err
+		}
+		if suite, err = addTest(suite, spec); err != nil {
+			return probe.Options{}, fmt.Errorf("%s: %w", id, err)
+		}
+	}
+	if to.Tests, err = probe.SelectTests(suite, req.Tests, req.SkipTests); err != nil {
+		return probe.Options{}, err
+	}
+
+	if req.Resolver != "" {
+		if to.Resolver, err = probe.NewResolver(req.Resolver); err != nil {
+			return probe.Options{}, err
+		}
+		to.ResolverName = req.Resolver
+	}
+	if to.PoisonCheck {
+		trusted := req.TrustedResolvers
+		if len(trusted) == 0 {
+			trusted = []string{defaultTrustedResolver}
+		}
+		for _, spec := range trusted {
+			r, err := probe.NewResolver(spec)
+			if err != nil {
+				return probe.Options{}, err
+			}
+			to.TrustedResolvers = append(to.TrustedResolvers, probe.NamedResolver{Name: spec, Resolver: r})
+		}
+	}
+
+	if req.Proxy != "" {
+		if to.Proxy, err = probe.NewProxy(req.Proxy); err != nil {
+			return probe.Options{}, err
+		}
+	}
+
+	if req.ECHConfig != "" {
+		if to.ECHConfigList, err = base64.StdEncoding.DecodeString(req.ECHConfig); err != nil {
+			return probe.Options{}, fmt.Errorf("invalid ech_config: %w", err)
+		}
+		if _, err := probe.ECHPublicName(to.ECHConfigList); err != nil {
+			return probe.Options{}, fmt.Errorf("invalid ech_config: %w", err)
+		}
+	}
+
+	return to, to.Validate()
+}
+
+// apiServer serves probes over HTTP.
+type apiServer struct {
+	a     *app
+	token string
+}
+
+func (s *apiServer) writeError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+// ServeHTTP handles POST /v1/probe. The results are returned as a single
+// JSON document in the --output json format, or as server-sent events if
+// the client asks for text/event-stream or sets ?stream=true: an "attempt"
+// event per attempt in the NDJSON record format, then a "result" event with
+// the whole document.
+func (s *apiServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.token != "" {
+		auth, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(auth), []byte(s.token)) != 1 {
+			s.writeError(w, http.StatusUnauthorized, errors.New("invalid token"))
+			return
+		}
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		s.writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	var req probeRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxProbeRequestSize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		s.writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+		return
+	}
+	to, err := req.testOptions()
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	to.Logger = s.a.l.With("remote", r.RemoteAddr)
+	stream := r.URL.Query().Get("stream") == "true" || strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	if !stream {
+		run, err := probe.Run(r.Context(), to)
+		if err != nil && len(run.Targets) == 0 {
+			s.writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(newRunReport(run))
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		s.writeError(w, http.StatusInternalServerError, errors.New("streaming not supported"))
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	var mu sync.Mutex
+	event := func(name string, v any) {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, data)
+		flusher.Flush()
+	}
+
+	to.OnAttempt = func(target probe.Target, tc probe.Test, addrPort netip.AddrPort, attempt int, res probe.AttemptResult) {
+		event("attempt", newAttemptRecord(target, tc, addrPort, attempt, res))
+	}
+	run, err := probe.Run(r.Context(), to)
+	if err != nil {
+		event("error", map[string]string{"error": err.Error()})
+	}
+	event("result", newRunReport(run))
+}
+
+// runAPIServer serves the API on listen until ctx is done.
+func runAPIServer(ctx context.Context, a *app, listen, token string) error {
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/v1/probe", &apiServer{a: a, token: token})
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return ctx },
+	}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	a.l.Info("serving API", "addr", "http://"+ln.Addr().String()+"/v1/probe")
+	if err := srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// newServeAPICommand runs probes on demand over HTTP.
+func newServeAPICommand(parent *ff.FlagSet, a *app) *ff.Command {
+	fs := ff.NewFlagSet("serve-api").SetParent(parent)
+	listen := fs.StringLong("listen", "localhost:9343", "address to serve the API on")
+	token := fs.StringLong("token", "", "require this bearer token on every request")
+
+	return &ff.Command{
+		Name:      "serve-api",
+		Usage:     appName + " serve-api [FLAGS]",
+		ShortHelp: "run tests on demand over an HTTP API",
+		Flags:     fs,
+		Exec: func(ctx context.Context, args []string) error {
+			return runAPIServer(ctx, a, *listen, *token)
+		},
+	}
+}
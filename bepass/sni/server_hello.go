@@ -0,0 +1,226 @@
+package sni
+
+import (
+	"bytes"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// helloRetryRequestRandom is the Random of a ServerHello that is a
+// HelloRetryRequest (RFC 8446, Section 4.1.3).
+var helloRetryRequestRandom = []byte{
+	0xCF, 0x21, 0xAD, 0x74, 0xE5, 0x9A, 0x61, 0x11,
+	0xBE, 0x1D, 0x8C, 0x02, 0x1E, 0x65, 0xB8, 0x91,
+	0xC2, 0xA2, 0x11, 0x16, 0x7A, 0xBB, 0x8C, 0x5E,
+	0x07, 0x9E, 0x09, 0xE2, 0xC8, 0xA8, 0x33, 0x9C,
+}
+
+// ReadServerHello reads the ServerHello at the start of the records in rd.
+func ReadServerHello(rd io.Reader) (*ServerHelloMsg, error) {
+	data, err := readHandshake(rd)
+	if err != nil {
+		return nil, err
+	}
+	return UnmarshalServerHello(data)
+}
+
+// UnmarshalServerHello parses a ServerHello handshake message, without the
+// record layer.
+func UnmarshalServerHello(data []byte) (*ServerHelloMsg, error) {
+	if !isHandshakeMessage(data, typeServerHello) {
+		return nil, errors.New("not a tls packet")
+	}
+	msg := new(ServerHelloMsg)
+	if !msg.unmarshal(data) {
+		return nil, errors.New("not a tls packet")
+	}
+	return msg, nil
+}
+
+// ServerHelloMsg represents a TLS ServerHello message, or a
+// HelloRetryRequest which shares its format.
+type ServerHelloMsg struct {
+	// Raw contains the raw bytes of the ServerHello message.
+	Raw               []byte
+	Versions          uint16
+	Random            []byte
+	SessionID         []byte
+	CipherSuite       uint16
+	CompressionMethod uint8
+	// HelloRetryRequest is true if the server asks the client to send its
+	// ClientHello again, with another key share or a cookie.
+	HelloRetryRequest            bool
+	NextProtoNeg                 bool
+	NextProtos                   []string
+	OcspStapling                 bool
+	TicketSupported              bool
+	SecureRenegotiationSupported bool
+	SecureRenegotiation          []byte
+	ExtendedMasterSecret         bool
+	ALPNProtocol                 string
+	SCTs                         [][]byte
+	SupportedVersion             uint16
+	// ServerShare is the key share of a ServerHello, and SelectedGroup the
+	// group a HelloRetryRequest asks for.
+	ServerShare             KeyShare
+	SelectedGroup           uint16
+	SelectedIdentityPresent bool
+	SelectedIdentity        uint16
+	SupportedPoints         []uint8
+	Cookie                  []byte
+	// EncryptedClientHello is the ECH confirmation of a
+	// HelloRetryRequest.
+	EncryptedClientHello []byte
+	// ServerNameAck is true if the server acknowledged the SNI with an
+	// empty server_name extension.
+	ServerNameAck bool
+	// Extensions holds every extension in the order they were sent,
+	// unknown ones included.
+	Extensions []Extension
+}
+
+func (m *ServerHelloMsg) unmarshal(data []byte) bool {
+	*m = ServerHelloMsg{Raw: data}
+	s := cryptobyte.String(data)
+
+	var sessionID cryptobyte.String
+	if !s.Skip(4) || // message type and uint24 length field
+		!s.ReadUint16(&m.Versions) || !s.ReadBytes(&m.Random, 32) ||
+		!s.ReadUint8LengthPrefixed(&sessionID) || len(sessionID) > 32 ||
+		!s.ReadUint16(&m.CipherSuite) ||
+		!s.ReadUint8(&m.CompressionMethod) {
+		return false
+	}
+	m.SessionID = sessionID
+	m.HelloRetryRequest = bytes.Equal(m.Random, helloRetryRequestRandom)
+
+	if s.Empty() {
+		// ServerHello is optionally followed by extension data
+		return true
+	}
+
+	var extensions cryptobyte.String
+	if !s.ReadUint16LengthPrefixed(&extensions) || !s.Empty() {
+		return false
+	}
+
+	for !extensions.Empty() {
+		offset := len(data) - len(extensions)
+		var extension uint16
+		var extData cryptobyte.String
+		if !extensions.ReadUint16(&extension) ||
+			!extensions.ReadUint16LengthPrefixed(&extData) {
+			return false
+		}
+		m.Extensions = append(m.Extensions, Extension{Type: extension, Data: extData, Offset: offset})
+		if !m.unmarshalExtension(extension, extData) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// unmarshalExtension reads the extension body extData into the fields of
+// the message. Unknown extensions are only kept in Extensions.
+func (m *ServerHelloMsg) unmarshalExtension(extension uint16, extData cryptobyte.String) bool {
+	switch extension {
+	case extensionNextProtoNeg:
+		m.NextProtoNeg = true
+		for !extData.Empty() {
+			var proto cryptobyte.String
+			if !extData.ReadUint8LengthPrefixed(&proto) {
+				return false
+			}
+			m.NextProtos = append(m.NextProtos, string(proto))
+		}
+	case extensionStatusRequest:
+		m.OcspStapling = true
+	case extensionSessionTicket:
+		m.TicketSupported = true
+	case extensionRenegotiationInfo:
+		var renegotiation cryptobyte.String
+		if !extData.ReadUint8LengthPrefixed(&renegotiation) {
+			return false
+		}
+		m.SecureRenegotiationSupported = true
+		m.SecureRenegotiation = renegotiation
+	case extensionExtendedMasterSecret:
+		m.ExtendedMasterSecret = true
+	case extensionALPN:
+		var protoList cryptobyte.String
+		if !extData.ReadUint16LengthPrefixed(&protoList) || protoList.Empty() {
+			return false
+		}
+		var proto cryptobyte.String
+		if !protoList.ReadUint8LengthPrefixed(&proto) ||
+			proto.Empty() || !protoList.Empty() {
+			return false
+		}
+		m.ALPNProtocol = string(proto)
+	case extensionSCT:
+		var sctList cryptobyte.String
+		if !extData.ReadUint16LengthPrefixed(&sctList) || sctList.Empty() {
+			return false
+		}
+		for !sctList.Empty() {
+			var sct cryptobyte.String
+			if !sctList.ReadUint16LengthPrefixed(&sct) || sct.Empty() {
+				return false
+			}
+			m.SCTs = append(m.SCTs, sct)
+		}
+	case extensionSupportedVersions:
+		if !extData.ReadUint16(&m.SupportedVersion) {
+			return false
+		}
+	case extensionCookie:
+		var cookie cryptobyte.String
+		if !extData.ReadUint16LengthPrefixed(&cookie) || cookie.Empty() {
+			return false
+		}
+		m.Cookie = cookie
+	case extensionKeyShare:
+		// This extension has different formats in SH and HRR, accept either
+		// and let the handshake logic decide. See RFC 8446, Section 4.2.8.
+		if len(extData) == 2 {
+			if !extData.ReadUint16(&m.SelectedGroup) {
+				return false
+			}
+		} else {
+			var keyExchange cryptobyte.String
+			if !extData.ReadUint16(&m.ServerShare.Group) ||
+				!extData.ReadUint16LengthPrefixed(&keyExchange) {
+				return false
+			}
+			m.ServerShare.Data = keyExchange
+		}
+	case extensionPreSharedKey:
+		m.SelectedIdentityPresent = true
+		if !extData.ReadUint16(&m.SelectedIdentity) {
+			return false
+		}
+	case extensionSupportedPoints:
+		// RFC 4492, Section 5.1.2
+		var points cryptobyte.String
+		if !extData.ReadUint8LengthPrefixed(&points) || points.Empty() {
+			return false
+		}
+		m.SupportedPoints = points
+	case extensionEncryptedClientHello:
+		m.EncryptedClientHello = extData
+		return true
+	case extensionServerName:
+		if len(extData) != 0 {
+			return false
+		}
+		m.ServerNameAck = true
+	default:
+		// Ignore unknown extensions.
+		return true
+	}
+
+	return extData.Empty()
+}
@@ -0,0 +1,256 @@
+package sni_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/markpash/heybabe/bepass/sni"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// readRecorder keeps everything read from the connection.
+type readRecorder struct {
+	net.Conn
+	read bytes.Buffer
+}
+
+func (c *readRecorder) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.read.Write(b[:n])
+	return n, err
+}
+
+func testCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, pub, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: priv}
+}
+
+// serverHelloRecords runs a handshake between a client and a server and
+// returns the records the client read.
+func serverHelloRecords(t *testing.T, client, server *tls.Config) []byte {
+	t.Helper()
+	// Both sides write at once after a HelloRetryRequest, which needs a
+	// buffered connection.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		tls.Server(c, server).Handshake()
+	}()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	conn := &readRecorder{Conn: c}
+	if err := tls.Client(conn, client).Handshake(); err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	return conn.read.Bytes()
+}
+
+func TestReadServerHello(t *testing.T) {
+	cert := testCertificate(t)
+	for _, tc := range []struct {
+		name    string
+		version uint16
+		group   tls.CurveID
+	}{
+		{"TLS 1.2", tls.VersionTLS12, tls.X25519},
+		{"TLS 1.3 X25519", tls.VersionTLS13, tls.X25519},
+		{"TLS 1.3 P-256", tls.VersionTLS13, tls.CurveP256},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			records := serverHelloRecords(t,
+				&tls.Config{
+					ServerName:         "example.com",
+					InsecureSkipVerify: true,
+					MaxVersion:         tc.version,
+					CurvePreferences:   []tls.CurveID{tc.group},
+					NextProtos:         []string{"h2"},
+				},
+				&tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"h2"}},
+			)
+			msg, err := sni.ReadServerHello(bytes.NewReader(records))
+			if err != nil {
+				t.Fatalf("ReadServerHello: %v", err)
+			}
+			if msg.HelloRetryRequest {
+				t.Error("HelloRetryRequest = true")
+			}
+			if msg.Versions != tls.VersionTLS12 {
+				t.Errorf("Versions = %#x, want TLS 1.2", msg.Versions)
+			}
+			if tc.version == tls.VersionTLS12 {
+				if msg.SupportedVersion != 0 || msg.ALPNProtocol != "h2" || !msg.ExtendedMasterSecret || !msg.SecureRenegotiationSupported {
+					t.Errorf("got %+v, want a TLS 1.2 ServerHello with ALPN, extended master secret and renegotiation info", msg)
+				}
+				return
+			}
+			if msg.SupportedVersion != tls.VersionTLS13 {
+				t.Errorf("SupportedVersion = %#x, want TLS 1.3", msg.SupportedVersion)
+			}
+			if msg.ServerShare.Group != uint16(tc.group) || len(msg.ServerShare.Data) == 0 {
+				t.Errorf("ServerShare = %+v, want a %s share", msg.ServerShare, tc.group)
+			}
+			if len(msg.Extensions) != 2 {
+				t.Errorf("got %d extensions, want supported_versions and key_share", len(msg.Extensions))
+			}
+		})
+	}
+}
+
+func TestReadServerHelloRetryRequest(t *testing.T) {
+	cert := testCertificate(t)
+	// The client only sends a key share for its first group, which the
+	// server doesn't take.
+	records := serverHelloRecords(t,
+		&tls.Config{
+			ServerName:         "example.com",
+			InsecureSkipVerify: true,
+			CurvePreferences:   []tls.CurveID{tls.X25519, tls.CurveP256},
+		},
+		&tls.Config{Certificates: []tls.Certificate{cert}, CurvePreferences: []tls.CurveID{tls.CurveP256}},
+	)
+	msg, err := sni.ReadServerHello(bytes.NewReader(records))
+	if err != nil {
+		t.Fatalf("ReadServerHello: %v", err)
+	}
+	if !msg.HelloRetryRequest {
+		t.Fatal("HelloRetryRequest = false")
+	}
+	if msg.SelectedGroup != uint16(tls.CurveP256) || msg.ServerShare.Data != nil {
+		t.Errorf("SelectedGroup = %#x and ServerShare = %+v, want P-256 and no share", msg.SelectedGroup, msg.ServerShare)
+	}
+	if msg.SupportedVersion != tls.VersionTLS13 {
+		t.Errorf("SupportedVersion = %#x, want TLS 1.3", msg.SupportedVersion)
+	}
+}
+
+// serverHello builds a ServerHello message with the extensions.
+func serverHello(random []byte, extensions func(b *cryptobyte.Builder)) []byte {
+	var b cryptobyte.Builder
+	b.AddUint8(2)
+	b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint16(tls.VersionTLS12)
+		b.AddBytes(random)
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(make([]byte, 32)) })
+		b.AddUint16(tls.TLS_AES_128_GCM_SHA256)
+		b.AddUint8(0)
+		b.AddUint16LengthPrefixed(extensions)
+	})
+	return b.BytesOrPanic()
+}
+
+func extension(typ uint16, body func(b *cryptobyte.Builder)) func(b *cryptobyte.Builder) {
+	return func(b *cryptobyte.Builder) {
+		b.AddUint16(typ)
+		b.AddUint16LengthPrefixed(body)
+	}
+}
+
+func TestUnmarshalServerHello(t *testing.T) {
+	helloRetryRequestRandom := []byte{
+		0xCF, 0x21, 0xAD, 0x74, 0xE5, 0x9A, 0x61, 0x11,
+		0xBE, 0x1D, 0x8C, 0x02, 0x1E, 0x65, 0xB8, 0x91,
+		0xC2, 0xA2, 0x11, 0x16, 0x7A, 0xBB, 0x8C, 0x5E,
+		0x07, 0x9E, 0x09, 0xE2, 0xC8, 0xA8, 0x33, 0x9C,
+	}
+	supportedVersion := extension(43, func(b *cryptobyte.Builder) { b.AddUint16(tls.VersionTLS13) })
+	hrr := serverHello(helloRetryRequestRandom, func(b *cryptobyte.Builder) {
+		supportedVersion(b)
+		extension(51, func(b *cryptobyte.Builder) { b.AddUint16(uint16(tls.CurveP256)) })(b)
+		extension(44, func(b *cryptobyte.Builder) {
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes([]byte("cookie")) })
+		})(b)
+		extension(0xfe0d, func(b *cryptobyte.Builder) { b.AddBytes(make([]byte, 8)) })(b)
+	})
+	msg, err := sni.UnmarshalServerHello(hrr)
+	if err != nil {
+		t.Fatalf("UnmarshalServerHello: %v", err)
+	}
+	if !msg.HelloRetryRequest || msg.SelectedGroup != uint16(tls.CurveP256) || string(msg.Cookie) != "cookie" || len(msg.EncryptedClientHello) != 8 {
+		t.Errorf("got %+v, want a HelloRetryRequest for P-256 with a cookie and an ECH confirmation", msg)
+	}
+	if types := []uint16{43, 51, 44, 0xfe0d}; len(msg.Extensions) != len(types) {
+		t.Errorf("got %d extensions, want %d", len(msg.Extensions), len(types))
+	} else {
+		for i, e := range msg.Extensions {
+			if e.Type != types[i] || uint16(hrr[e.Offset])<<8|uint16(hrr[e.Offset+1]) != types[i] {
+				t.Errorf("extension %d: type %d at offset %d, want %d", i, e.Type, e.Offset, types[i])
+			}
+		}
+	}
+
+	random := make([]byte, 32)
+	sh := serverHello(random, func(b *cryptobyte.Builder) {
+		supportedVersion(b)
+		extension(51, func(b *cryptobyte.Builder) {
+			b.AddUint16(uint16(tls.X25519))
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(make([]byte, 32)) })
+		})(b)
+	})
+	if msg, err := sni.UnmarshalServerHello(sh); err != nil {
+		t.Errorf("UnmarshalServerHello: %v", err)
+	} else if msg.HelloRetryRequest || msg.ServerShare.Group != uint16(tls.X25519) || len(msg.ServerShare.Data) != 32 {
+		t.Errorf("got %+v, want a ServerHello with an X25519 share", msg)
+	}
+
+	for n := range len(sh) {
+		if _, err := sni.UnmarshalServerHello(sh[:n]); err == nil {
+			t.Errorf("message truncated to %d bytes was accepted", n)
+		}
+	}
+	for _, tc := range []struct {
+		name string
+		data []byte
+	}{
+		{"client hello type", append([]byte{1}, sh[1:]...)},
+		{"trailing data", append(bytes.Clone(sh), 0)},
+		{"two ALPN protocols", serverHello(random, extension(16, func(b *cryptobyte.Builder) {
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes([]byte("h2")) })
+				b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes([]byte("h3")) })
+			})
+		}))},
+		{"long supported version", serverHello(random, extension(43, func(b *cryptobyte.Builder) {
+			b.AddUint16(tls.VersionTLS13)
+			b.AddUint8(0)
+		}))},
+		{"server name with data", serverHello(random, extension(0, func(b *cryptobyte.Builder) { b.AddUint8(0) }))},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := sni.UnmarshalServerHello(tc.data); err == nil {
+				t.Error("malformed message was accepted")
+			}
+		})
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"errors"
 	"io"
+
+	"golang.org/x/crypto/cryptobyte"
 )
 
 const (
@@ -20,16 +22,32 @@ const (
 // TLS handshake message types.
 const (
 	typeClientHello uint8 = 1
+	typeServerHello uint8 = 2
 )
 
 // TLS extension numbers
 var (
-	extensionServerName      uint16
-	extensionStatusRequest   uint16 = 5
-	extensionSupportedCurves uint16 = 10
-	extensionSupportedPoints uint16 = 11
-	extensionSessionTicket   uint16 = 35
-	extensionNextProtoNeg    uint16 = 13172 // not IANA assigned
+	extensionServerName              uint16
+	extensionStatusRequest           uint16 = 5
+	extensionSupportedCurves         uint16 = 10
+	extensionSupportedPoints         uint16 = 11
+	extensionSignatureAlgorithms     uint16 = 13
+	extensionALPN                    uint16 = 16
+	extensionSCT                     uint16 = 18
+	extensionPadding                 uint16 = 21
+	extensionExtendedMasterSecret    uint16 = 23
+	extensionSessionTicket           uint16 = 35
+	extensionPreSharedKey            uint16 = 41
+	extensionEarlyData               uint16 = 42
+	extensionSupportedVersions       uint16 = 43
+	extensionCookie                  uint16 = 44
+	extensionPSKModes                uint16 = 45
+	extensionSignatureAlgorithmsCert uint16 = 50
+	extensionKeyShare                uint16 = 51
+	extensionQUICTransportParameters uint16 = 57
+	extensionNextProtoNeg            uint16 = 13172 // not IANA assigned
+	extensionEncryptedClientHello    uint16 = 0xfe0d
+	extensionRenegotiationInfo       uint16 = 0xff01
 )
 
 // TLS CertificateStatusType (RFC 3546)
@@ -116,9 +134,8 @@ func splitBlock(b *block, n int) (*block, *block) {
 	return b, bb
 }
 
-// ReadClientHello readHandshake reads the next handshake message from
-// the record layer.
-func ReadClientHello(rd io.Reader) (*ClientHelloMsg, error) {
+// readHandshake reads the first handshake message from the record layer.
+func readHandshake(rd io.Reader) ([]byte, error) {
 	var nextBlock *block  // raw input, right off the wire
 	var hand bytes.Buffer // handshake data waiting to be read
 
@@ -173,14 +190,14 @@ func ReadClientHello(rd io.Reader) (*ClientHelloMsg, error) {
 		return nil
 	}
 
-	if err := readRecord(); err != nil {
-		return nil, err
+	// The header of the message may be split over records too.
+	for hand.Len() < 4 {
+		if err := readRecord(); err != nil {
+			return nil, err
+		}
 	}
 
 	data := hand.Bytes()
-	if len(data) < 4 {
-		return nil, errors.New("not a tls packet")
-	}
 	n := int(data[1])<<16 | int(data[2])<<8 | int(data[3])
 
 	for hand.Len() < 4+n {
@@ -189,19 +206,79 @@ func ReadClientHello(rd io.Reader) (*ClientHelloMsg, error) {
 		}
 	}
 
-	data = hand.Next(4 + n)
-	if data[0] != typeClientHello {
-		return nil, errors.New("not a tls packet")
+	return hand.Next(4 + n), nil
+}
+
+// ReadClientHello reads the ClientHello at the start of the records in rd.
+func ReadClientHello(rd io.Reader) (*ClientHelloMsg, error) {
+	data, err := readHandshake(rd)
+	if err != nil {
+		return nil, err
 	}
+	return UnmarshalClientHello(data)
+}
 
+// UnmarshalClientHello parses a ClientHello handshake message, without the
+// record layer, as QUIC carries it.
+func UnmarshalClientHello(data []byte) (*ClientHelloMsg, error) {
+	if !isHandshakeMessage(data, typeClientHello) {
+		return nil, errors.New("not a tls packet")
+	}
 	msg := new(ClientHelloMsg)
 	if !msg.unmarshal(data) {
 		return nil, errors.New("not a tls packet")
 	}
-
 	return msg, nil
 }
 
+// isHandshakeMessage reports whether data is a single handshake message of
+// type typ, as long as its header says.
+func isHandshakeMessage(data []byte, typ uint8) bool {
+	return len(data) >= 4 && data[0] == typ &&
+		int(data[1])<<16|int(data[2])<<8|int(data[3]) == len(data)-4
+}
+
+// IsGREASE reports whether v is one of the GREASE values (RFC 8701) clients
+// put in their lists to keep servers tolerant of unknown ones.
+func IsGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// Extension is an extension of a hello message, as it was sent.
+type Extension struct {
+	Type uint16
+	// Data is the body of the extension, after its type and length.
+	Data []byte
+	// Offset is where the extension starts, at its type, in the Raw bytes
+	// of the message.
+	Offset int
+}
+
+// KeyShare is an entry of the key_share extension.
+type KeyShare struct {
+	Group uint16
+	Data  []byte
+}
+
+// PSKIdentity is an identity of the pre_shared_key extension.
+type PSKIdentity struct {
+	Label               []byte
+	ObfuscatedTicketAge uint32
+}
+
+// EncryptedClientHello is the encrypted_client_hello extension of a
+// ClientHello.
+type EncryptedClientHello struct {
+	// Type is 0 for an outer ClientHello and 1 for an inner one, which
+	// has none of the other fields.
+	Type     uint8
+	KDF      uint16
+	AEAD     uint16
+	ConfigID uint8
+	Enc      []byte
+	Payload  []byte
+}
+
 // ClientHelloMsg represents a TLS ClientHello message. It contains various fields
 // that store information about the client's hello message during a TLS handshake.
 type ClientHelloMsg struct {
@@ -214,147 +291,303 @@ type ClientHelloMsg struct {
 	CompressionMethods []uint8
 	NextProtoNeg       bool
 	ServerName         string
-	OcspStapling       bool
-	SupportedCurves    []uint16
-	SupportedPoints    []uint8
-	TicketSupported    bool
-	SessionTicket      []uint8
+	// ServerNameOffset is where ServerName starts in Raw, 0 if there is
+	// none.
+	ServerNameOffset                 int
+	OcspStapling                     bool
+	SupportedCurves                  []uint16
+	SupportedPoints                  []uint8
+	TicketSupported                  bool
+	SessionTicket                    []uint8
+	SupportedSignatureAlgorithms     []uint16
+	SupportedSignatureAlgorithmsCert []uint16
+	SecureRenegotiationSupported     bool
+	SecureRenegotiation              []byte
+	ExtendedMasterSecret             bool
+	ALPNProtocols                    []string
+	SCTs                             bool
+	SupportedVersions                []uint16
+	Cookie                           []byte
+	KeyShares                        []KeyShare
+	EarlyData                        bool
+	PSKModes                         []uint8
+	PSKIdentities                    []PSKIdentity
+	PSKBinders                       [][]byte
+	// PaddingLen is the length of the padding extension.
+	PaddingLen              int
+	QUICTransportParameters []byte
+	EncryptedClientHello    *EncryptedClientHello
+	// Extensions holds every extension in the order they were sent,
+	// GREASE and unknown ones included.
+	Extensions []Extension
 }
 
-func (m *ClientHelloMsg) unmarshal(data []byte) bool {
-	if len(data) < 42 {
+// readUint16List reads a list of uint16s with a length prefix of two bytes,
+// or of one.
+func readUint16List(s *cryptobyte.String, list *[]uint16, twoByteLength bool) bool {
+	var values cryptobyte.String
+	if twoByteLength {
+		if !s.ReadUint16LengthPrefixed(&values) {
+			return false
+		}
+	} else if !s.ReadUint8LengthPrefixed(&values) {
 		return false
 	}
-	m.Raw = data
-	m.Versions = uint16(data[4])<<8 | uint16(data[5])
-	m.Random = data[6:38]
-	sessionIDLen := int(data[38])
-	if sessionIDLen > 32 || len(data) < 39+sessionIDLen {
+	if len(values)%2 != 0 {
 		return false
 	}
-	m.SessionID = data[39 : 39+sessionIDLen]
-	data = data[39+sessionIDLen:]
-	if len(data) < 2 {
-		return false
+	*list = nil
+	for !values.Empty() {
+		var v uint16
+		if !values.ReadUint16(&v) {
+			return false
+		}
+		*list = append(*list, v)
 	}
-	// cipherSuiteLen is the number of bytes of cipher suite numbers. Since
-	// they are uint16s, the number must be even.
-	cipherSuiteLen := int(data[0])<<8 | int(data[1])
-	if cipherSuiteLen%2 == 1 || len(data) < 2+cipherSuiteLen {
+	return true
+}
+
+func (m *ClientHelloMsg) unmarshal(data []byte) bool {
+	*m = ClientHelloMsg{Raw: data}
+	s := cryptobyte.String(data)
+
+	var sessionID cryptobyte.String
+	if !s.Skip(4) || // message type and uint24 length field
+		!s.ReadUint16(&m.Versions) || !s.ReadBytes(&m.Random, 32) ||
+		!s.ReadUint8LengthPrefixed(&sessionID) || len(sessionID) > 32 {
 		return false
 	}
-	numCipherSuites := cipherSuiteLen / 2
-	m.CipherSuites = make([]uint16, numCipherSuites)
-	for i := 0; i < numCipherSuites; i++ {
-		m.CipherSuites[i] = uint16(data[2+2*i])<<8 | uint16(data[3+2*i])
-	}
-	data = data[2+cipherSuiteLen:]
-	if len(data) < 1 {
+	m.SessionID = sessionID
+
+	if !readUint16List(&s, &m.CipherSuites, true) {
 		return false
 	}
-	compressionMethodsLen := int(data[0])
-	if len(data) < 1+compressionMethodsLen {
+
+	var compressionMethods cryptobyte.String
+	if !s.ReadUint8LengthPrefixed(&compressionMethods) {
 		return false
 	}
-	m.CompressionMethods = data[1 : 1+compressionMethodsLen]
-
-	data = data[1+compressionMethodsLen:]
-
-	m.NextProtoNeg = false
-	m.ServerName = ""
-	m.OcspStapling = false
-	m.TicketSupported = false
-	m.SessionTicket = nil
+	m.CompressionMethods = compressionMethods
 
-	if len(data) == 0 {
+	if s.Empty() {
 		// ClientHello is optionally followed by extension data
 		return true
 	}
-	if len(data) < 2 {
-		return false
-	}
 
-	extensionsLength := int(data[0])<<8 | int(data[1])
-	data = data[2:]
-	if extensionsLength != len(data) {
+	var extensions cryptobyte.String
+	if !s.ReadUint16LengthPrefixed(&extensions) || !s.Empty() {
 		return false
 	}
 
-	for len(data) != 0 {
-		if len(data) < 4 {
+	for !extensions.Empty() {
+		offset := len(data) - len(extensions)
+		var extension uint16
+		var extData cryptobyte.String
+		if !extensions.ReadUint16(&extension) ||
+			!extensions.ReadUint16LengthPrefixed(&extData) {
 			return false
 		}
-		extension := uint16(data[0])<<8 | uint16(data[1])
-		length := int(data[2])<<8 | int(data[3])
-		data = data[4:]
-		if len(data) < length {
+		m.Extensions = append(m.Extensions, Extension{Type: extension, Data: extData, Offset: offset})
+		if !m.unmarshalExtension(extension, extData, offset+4) {
 			return false
 		}
+	}
+
+	return true
+}
 
-		switch extension {
-		case extensionServerName:
-			if length < 2 {
+// unmarshalExtension reads the extension body extData, at offset in Raw,
+// into the fields of the message. Unknown extensions are only kept in
+// Extensions.
+func (m *ClientHelloMsg) unmarshalExtension(extension uint16, extData cryptobyte.String, offset int) bool {
+	switch extension {
+	case extensionServerName:
+		// RFC 6066, Section 3
+		body := extData
+		var nameList cryptobyte.String
+		if !extData.ReadUint16LengthPrefixed(&nameList) || nameList.Empty() {
+			return false
+		}
+		for !nameList.Empty() {
+			var nameType uint8
+			var serverName cryptobyte.String
+			if !nameList.ReadUint8(&nameType) ||
+				!nameList.ReadUint16LengthPrefixed(&serverName) ||
+				serverName.Empty() {
 				return false
 			}
-			numNames := int(data[0])<<8 | int(data[1])
-			d := data[2:]
-			for i := 0; i < numNames; i++ {
-				if len(d) < 3 {
-					return false
-				}
-				nameType := d[0]
-				nameLen := int(d[1])<<8 | int(d[2])
-				d = d[3:]
-				if len(d) < nameLen {
-					return false
-				}
-				if nameType == 0 {
-					m.ServerName = string(d[0:nameLen])
-					break
-				}
-				d = d[nameLen:]
+			if nameType != 0 || m.ServerName != "" {
+				continue
 			}
-		case extensionNextProtoNeg:
-			if length > 0 {
+			m.ServerName = string(serverName)
+			// The name ends where the rest of the list and of the body
+			// start.
+			m.ServerNameOffset = offset + len(body) - len(extData) - len(nameList) - len(serverName)
+		}
+		return extData.Empty()
+	case extensionNextProtoNeg:
+		m.NextProtoNeg = true
+		return extData.Empty()
+	case extensionStatusRequest:
+		// RFC 4366, Section 3.6
+		var statusType uint8
+		var ignored cryptobyte.String
+		if !extData.ReadUint8(&statusType) ||
+			!extData.ReadUint16LengthPrefixed(&ignored) ||
+			!extData.ReadUint16LengthPrefixed(&ignored) {
+			return false
+		}
+		m.OcspStapling = statusType == statusTypeOCSP
+	case extensionSupportedCurves:
+		// RFC 4492, sections 5.1.1 and RFC 8446, Section 4.2.7
+		if !readUint16List(&extData, &m.SupportedCurves, true) {
+			return false
+		}
+	case extensionSupportedPoints:
+		// RFC 4492, Section 5.1.2
+		var points cryptobyte.String
+		if !extData.ReadUint8LengthPrefixed(&points) || points.Empty() {
+			return false
+		}
+		m.SupportedPoints = points
+	case extensionSessionTicket:
+		// RFC 5077, Section 3.2
+		m.TicketSupported = true
+		m.SessionTicket = extData
+		return true
+	case extensionSignatureAlgorithms:
+		// RFC 5246, Section 7.4.1.4.1
+		if !readUint16List(&extData, &m.SupportedSignatureAlgorithms, true) {
+			return false
+		}
+	case extensionSignatureAlgorithmsCert:
+		// RFC 8446, Section 4.2.3
+		if !readUint16List(&extData, &m.SupportedSignatureAlgorithmsCert, true) {
+			return false
+		}
+	case extensionRenegotiationInfo:
+		// RFC 5746, Section 3.2
+		var renegotiation cryptobyte.String
+		if !extData.ReadUint8LengthPrefixed(&renegotiation) {
+			return false
+		}
+		m.SecureRenegotiationSupported = true
+		m.SecureRenegotiation = renegotiation
+	case extensionExtendedMasterSecret:
+		// RFC 7627
+		m.ExtendedMasterSecret = true
+	case extensionALPN:
+		// RFC 7301, Section 3.1
+		var protoList cryptobyte.String
+		if !extData.ReadUint16LengthPrefixed(&protoList) || protoList.Empty() {
+			return false
+		}
+		m.ALPNProtocols = nil
+		for !protoList.Empty() {
+			var proto cryptobyte.String
+			if !protoList.ReadUint8LengthPrefixed(&proto) || proto.Empty() {
 				return false
 			}
-			m.NextProtoNeg = true
-		case extensionStatusRequest:
-			m.OcspStapling = length > 0 && data[0] == statusTypeOCSP
-		case extensionSupportedCurves:
-			// http://tools.ietf.org/html/rfc4492#section-5.5.1
-			if length < 2 {
+			m.ALPNProtocols = append(m.ALPNProtocols, string(proto))
+		}
+	case extensionSCT:
+		// RFC 6962, Section 3.3.1
+		m.SCTs = true
+	case extensionSupportedVersions:
+		// RFC 8446, Section 4.2.1
+		if !readUint16List(&extData, &m.SupportedVersions, false) {
+			return false
+		}
+	case extensionCookie:
+		// RFC 8446, Section 4.2.2
+		var cookie cryptobyte.String
+		if !extData.ReadUint16LengthPrefixed(&cookie) || cookie.Empty() {
+			return false
+		}
+		m.Cookie = cookie
+	case extensionKeyShare:
+		// RFC 8446, Section 4.2.8
+		var clientShares cryptobyte.String
+		if !extData.ReadUint16LengthPrefixed(&clientShares) {
+			return false
+		}
+		m.KeyShares = nil
+		for !clientShares.Empty() {
+			var ks KeyShare
+			var keyExchange cryptobyte.String
+			if !clientShares.ReadUint16(&ks.Group) ||
+				!clientShares.ReadUint16LengthPrefixed(&keyExchange) || keyExchange.Empty() {
 				return false
 			}
-			l := int(data[0])<<8 | int(data[1])
-			if l%2 == 1 || length != l+2 {
+			ks.Data = keyExchange
+			m.KeyShares = append(m.KeyShares, ks)
+		}
+	case extensionEarlyData:
+		// RFC 8446, Section 4.2.10
+		m.EarlyData = true
+	case extensionPSKModes:
+		// RFC 8446, Section 4.2.9
+		var modes cryptobyte.String
+		if !extData.ReadUint8LengthPrefixed(&modes) {
+			return false
+		}
+		m.PSKModes = modes
+	case extensionPreSharedKey:
+		// RFC 8446, Section 4.2.11
+		var identities, binders cryptobyte.String
+		if !extData.ReadUint16LengthPrefixed(&identities) || identities.Empty() {
+			return false
+		}
+		m.PSKIdentities = nil
+		for !identities.Empty() {
+			var psk PSKIdentity
+			var label cryptobyte.String
+			if !identities.ReadUint16LengthPrefixed(&label) || label.Empty() ||
+				!identities.ReadUint32(&psk.ObfuscatedTicketAge) {
 				return false
 			}
-			numCurves := l / 2
-			m.SupportedCurves = make([]uint16, numCurves)
-			d := data[2:]
-			for i := 0; i < numCurves; i++ {
-				m.SupportedCurves[i] = uint16(d[0])<<8 | uint16(d[1])
-				d = d[2:]
-			}
-		case extensionSupportedPoints:
-			// http://tools.ietf.org/html/rfc4492#section-5.5.2
-			if length < 1 {
+			psk.Label = label
+			m.PSKIdentities = append(m.PSKIdentities, psk)
+		}
+		if !extData.ReadUint16LengthPrefixed(&binders) || binders.Empty() {
+			return false
+		}
+		m.PSKBinders = nil
+		for !binders.Empty() {
+			var binder cryptobyte.String
+			if !binders.ReadUint8LengthPrefixed(&binder) || binder.Empty() {
 				return false
 			}
-			l := int(data[0])
-			if length != l+1 {
+			m.PSKBinders = append(m.PSKBinders, binder)
+		}
+	case extensionPadding:
+		// RFC 7685
+		m.PaddingLen = len(extData)
+		return true
+	case extensionQUICTransportParameters:
+		m.QUICTransportParameters = extData
+		return true
+	case extensionEncryptedClientHello:
+		// draft-ietf-tls-esni, Section 5
+		ech := new(EncryptedClientHello)
+		if !extData.ReadUint8(&ech.Type) {
+			return false
+		}
+		if ech.Type == 0 {
+			var enc, payload cryptobyte.String
+			if !extData.ReadUint16(&ech.KDF) || !extData.ReadUint16(&ech.AEAD) ||
+				!extData.ReadUint8(&ech.ConfigID) ||
+				!extData.ReadUint16LengthPrefixed(&enc) ||
+				!extData.ReadUint16LengthPrefixed(&payload) {
 				return false
 			}
-			m.SupportedPoints = make([]uint8, l)
-			copy(m.SupportedPoints, data[1:])
-		case extensionSessionTicket:
-			// http://tools.ietf.org/html/rfc5077#section-3.2
-			m.TicketSupported = true
-			m.SessionTicket = data[:length]
-		}
-		data = data[length:]
+			ech.Enc, ech.Payload = enc, payload
+		}
+		m.EncryptedClientHello = ech
+	default:
+		// Ignore unknown extensions.
+		return true
 	}
 
-	return true
+	return extData.Empty()
 }
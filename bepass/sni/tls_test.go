@@ -0,0 +1,229 @@
+package sni_test
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/markpash/heybabe/bepass/sni"
+	utls "github.com/refraction-networking/utls"
+)
+
+var errCaptured = errors.New("captured")
+
+// captureConn keeps the first write, the ClientHello records, and fails it
+// so that the handshake stops there.
+type captureConn struct {
+	net.Conn
+	records []byte
+}
+
+func (c *captureConn) Write(b []byte) (int, error) {
+	if c.records == nil {
+		c.records = append([]byte(nil), b...)
+	}
+	return 0, errCaptured
+}
+
+// clientHelloRecords returns the records of the ClientHello the fingerprint
+// sends for serverName.
+func clientHelloRecords(t *testing.T, id utls.ClientHelloID, serverName string) []byte {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	conn := &captureConn{Conn: c1}
+	uConn := utls.UClient(conn, &utls.Config{ServerName: serverName, OmitEmptyPsk: true}, id)
+	if err := uConn.Handshake(); !errors.Is(err, errCaptured) {
+		t.Fatalf("handshake: %v", err)
+	}
+	return conn.records
+}
+
+// splitRecords splits the handshake messages of records into records of at
+// most n bytes.
+func splitRecords(records []byte, n int) []byte {
+	var msgs, out []byte
+	for len(records) >= 5 {
+		length := int(records[3])<<8 | int(records[4])
+		msgs = append(msgs, records[5:5+length]...)
+		records = records[5+length:]
+	}
+	for len(msgs) > 0 {
+		fragment := msgs[:min(n, len(msgs))]
+		msgs = msgs[len(fragment):]
+		out = append(out, 0x16, 0x03, 0x01, byte(len(fragment)>>8), byte(len(fragment)))
+		out = append(out, fragment...)
+	}
+	return out
+}
+
+// fingerprints are ClientHellos of every family uTLS knows, with and without
+// GREASE, PSK, padding, post-quantum key shares and shuffled extensions.
+var fingerprints = []utls.ClientHelloID{
+	utls.HelloGolang,
+	utls.HelloRandomized,
+	utls.HelloRandomizedNoALPN,
+	utls.HelloFirefox_55,
+	utls.HelloFirefox_120,
+	utls.HelloChrome_58,
+	utls.HelloChrome_83,
+	utls.HelloChrome_106_Shuffle,
+	utls.HelloChrome_114_Padding_PSK_Shuf,
+	utls.HelloChrome_115_PQ,
+	utls.HelloChrome_120,
+	utls.HelloChrome_131,
+	utls.HelloIOS_11_1,
+	utls.HelloIOS_14,
+	utls.HelloAndroid_11_OkHttp,
+	utls.HelloEdge_106,
+	utls.HelloSafari_16_0,
+	utls.Hello360_11_0,
+	utls.HelloQQ_11_1,
+}
+
+func TestReadClientHelloFingerprints(t *testing.T) {
+	const serverName = "www.example.com"
+	for _, id := range fingerprints {
+		t.Run(id.Str(), func(t *testing.T) {
+			records := clientHelloRecords(t, id, serverName)
+			msg, err := sni.ReadClientHello(bytes.NewReader(records))
+			if err != nil {
+				t.Fatalf("ReadClientHello: %v", err)
+			}
+			if msg.ServerName != serverName {
+				t.Errorf("ServerName = %q, want %q", msg.ServerName, serverName)
+			}
+			if got := string(msg.Raw[msg.ServerNameOffset:][:len(serverName)]); got != serverName {
+				t.Errorf("Raw at ServerNameOffset %d = %q, want %q", msg.ServerNameOffset, got, serverName)
+			}
+			if len(msg.CipherSuites) == 0 || len(msg.Extensions) == 0 {
+				t.Fatalf("got %d cipher suites and %d extensions", len(msg.CipherSuites), len(msg.Extensions))
+			}
+			for _, e := range msg.Extensions {
+				if got := uint16(msg.Raw[e.Offset])<<8 | uint16(msg.Raw[e.Offset+1]); got != e.Type {
+					t.Errorf("extension %d: Raw at Offset %d has type %d", e.Type, e.Offset, got)
+				}
+				if !bytes.Equal(msg.Raw[e.Offset+4:][:len(e.Data)], e.Data) {
+					t.Errorf("extension %d: Data is not at Offset %d", e.Type, e.Offset)
+				}
+			}
+			last := msg.Extensions[len(msg.Extensions)-1]
+			if end := last.Offset + 4 + len(last.Data); end != len(msg.Raw) {
+				t.Errorf("extensions end at %d, the message at %d", end, len(msg.Raw))
+			}
+
+			// The message is the same when the records split it.
+			for _, n := range []int{1, 7, 100} {
+				split, err := sni.ReadClientHello(bytes.NewReader(splitRecords(records, n)))
+				if err != nil {
+					t.Fatalf("ReadClientHello of %d byte records: %v", n, err)
+				}
+				if !bytes.Equal(split.Raw, msg.Raw) || split.ServerNameOffset != msg.ServerNameOffset {
+					t.Errorf("%d byte records: got another message", n)
+				}
+			}
+		})
+	}
+}
+
+func TestUnmarshalClientHelloFields(t *testing.T) {
+	records := clientHelloRecords(t, utls.HelloChrome_120, "example.com")
+	msg, err := sni.ReadClientHello(bytes.NewReader(records))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Versions != utls.VersionTLS12 {
+		t.Errorf("Versions = %#x, want TLS 1.2", msg.Versions)
+	}
+	if len(msg.Random) != 32 || len(msg.SessionID) != 32 {
+		t.Errorf("got a %d byte random and a %d byte session ID", len(msg.Random), len(msg.SessionID))
+	}
+	if want := []string{"h2", "http/1.1"}; len(msg.ALPNProtocols) != 2 || msg.ALPNProtocols[0] != want[0] || msg.ALPNProtocols[1] != want[1] {
+		t.Errorf("ALPNProtocols = %q, want %q", msg.ALPNProtocols, want)
+	}
+	if !sni.IsGREASE(msg.SupportedVersions[0]) || msg.SupportedVersions[1] != utls.VersionTLS13 {
+		t.Errorf("SupportedVersions = %#x, want GREASE then TLS 1.3", msg.SupportedVersions)
+	}
+	if len(msg.KeyShares) != 2 || !sni.IsGREASE(msg.KeyShares[0].Group) || msg.KeyShares[1].Group != uint16(utls.X25519) || len(msg.KeyShares[1].Data) != 32 {
+		t.Errorf("KeyShares = %+v, want GREASE and X25519", msg.KeyShares)
+	}
+	if len(msg.SupportedSignatureAlgorithms) == 0 || len(msg.PSKModes) == 0 || !msg.ExtendedMasterSecret || !msg.SecureRenegotiationSupported {
+		t.Errorf("missing signature algorithms, PSK modes, extended master secret or renegotiation info")
+	}
+	if ech := msg.EncryptedClientHello; ech == nil || ech.Type != 0 || len(ech.Payload) == 0 {
+		t.Errorf("EncryptedClientHello = %+v, want a GREASE outer extension", ech)
+	}
+	if !sni.IsGREASE(msg.Extensions[0].Type) || !sni.IsGREASE(msg.Extensions[len(msg.Extensions)-1].Type) {
+		t.Errorf("the first and last extensions are not GREASE")
+	}
+}
+
+func TestUnmarshalClientHelloMalformed(t *testing.T) {
+	records := clientHelloRecords(t, utls.HelloChrome_120, "example.com")
+	msg, err := sni.ReadClientHello(bytes.NewReader(records))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := msg.Raw
+
+	// Every truncation is rejected, whether the length fields are left as
+	// they are or not.
+	for n := range len(raw) {
+		if _, err := sni.UnmarshalClientHello(raw[:n]); err == nil {
+			t.Errorf("message truncated to %d bytes was accepted", n)
+		}
+	}
+	for n := range len(records) {
+		if _, err := sni.ReadClientHello(bytes.NewReader(records[:n])); err == nil {
+			t.Errorf("records truncated to %d bytes were accepted", n)
+		}
+	}
+
+	withByte := func(i int, b ...byte) []byte {
+		data := bytes.Clone(raw)
+		copy(data[i:], b)
+		return data
+	}
+	sniExt := msg.Extensions[0]
+	for _, e := range msg.Extensions {
+		if e.Type == 0 {
+			sniExt = e
+		}
+	}
+	for _, tc := range []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"server hello type", withByte(0, 2)},
+		{"long session id", withByte(4+2+32, 33)},
+		{"odd cipher suites length", withByte(4+2+32+1+32+1, raw[4+2+32+1+32+1]+1)},
+		{"trailing data", append(bytes.Clone(raw), 0)},
+		{"extension past the end", withByte(sniExt.Offset+2, 0xff, 0xff)},
+		{"server name past its list", withByte(sniExt.Offset+4+2+1, 0xff, 0xff)},
+		{"server name list too short", withByte(sniExt.Offset+4, 0, raw[sniExt.Offset+4+1]-1)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := sni.UnmarshalClientHello(tc.data); err == nil {
+				t.Error("malformed message was accepted")
+			}
+		})
+	}
+
+	for _, tc := range []struct {
+		name    string
+		records []byte
+	}{
+		{"alert record", append([]byte{0x15}, records[1:]...)},
+		{"empty record", []byte{0x16, 0x03, 0x01, 0x00, 0x00}},
+		{"record too long", []byte{0x16, 0x03, 0x01, 0xff, 0xff}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := sni.ReadClientHello(bytes.NewReader(tc.records)); err == nil {
+				t.Error("malformed records were accepted")
+			}
+		})
+	}
+}
@@ -100,8 +100,14 @@ func (a *Adapter) fragmentAndWriteFirstPacket(b []byte) (int, error) {
 	/*
 		splitting original hello packet to BeforeSNI, SNI, AfterSNI chunks
 	*/
-	// search for sni through original tls client hello
-	index := bytes.Index(b, helloPacketSni)
+	// the offset of the sni is known when the hello fits in the first
+	// record, otherwise search for it through the original packet
+	var index int
+	if recordLen := int(b[3])<<8 | int(b[4]); hello.ServerNameOffset > 0 && recordLen >= len(hello.Raw) {
+		index = 5 + hello.ServerNameOffset
+	} else {
+		index = bytes.Index(b, helloPacketSni)
+	}
 	if index == -1 {
 		return a.conn.Write(b)
 	}
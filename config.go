@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/markpash/heybabe/probe"
+	"github.com/pelletier/go-toml/v2"
+	"github.com/peterbourgon/ff/v4"
+	"gopkg.in/yaml.v3"
+)
+
+// envVarPrefix prefixes the environment variables every flag can be set
+// with, such as HEYBABE_SNI or HEYBABE_SOURCE_IP.
+const envVarPrefix = "HEYBABE"
+
+// fragmentConfig is FragmentOptions in a config file, each range as
+// [min, max].
+type fragmentConfig struct {
+	BeforeSNI [2]int `json:"before_sni"`
+	SNI       [2]int `json:"sni"`
+	AfterSNI  [2]int `json:"after_sni"`
+	Delay     [2]int `json:"delay"`
+}
+
+// overrideConfig is an entry of the override list of a config file.
+type overrideConfig struct {
+	Tests       string          `json:"tests"`
+	Fingerprint string          `json:"fingerprint"`
+	Fragment    *fragmentConfig `json:"fragment"`
+}
+
+func (oc overrideConfig) override() (probe.Override, error) {
+	if oc.Tests == "" {
+		return probe.Override{}, errors.New("missing tests")
+	}
+	o := probe.Override{Tests: oc.Tests}
+	if oc.Fingerprint != "" {
+		id, err := probe.ParseFingerprint(oc.Fingerprint)
+		if err != nil {
+			return probe.Override{}, err
+		}
+		o.ClientHelloID = &id
+	}
+	if f := oc.Fragment; f != nil {
+		o.Fragment = &probe.FragmentOptions{BeforeSNI: f.BeforeSNI, SNI: f.SNI, AfterSNI: f.AfterSNI, Delay: f.Delay}
+	}
+	return o, nil
+}
+
+// configLoader parses the --config file. Its top level keys are flags by
+// their long name, plus an override list and a profile table of named
+// sections of more of the same. The selected profile's keys replace those
+// at the top level, and its overrides come after the top level ones.
+type configLoader struct {
+	root    *ff.Command
+	path    *string
+	profile *string
+
+	// overrides are those of the last parse.
+	overrides []probe.Override
+}
+
+// decode reads the config file into a map, by the format its extension
+// says.
+func (cl *configLoader) decode(r io.Reader) (map[string]any, error) {
+	var m map[string]any
+	switch ext := strings.ToLower(filepath.Ext(*cl.path)); ext {
+	case ".toml":
+		if err := toml.NewDecoder(r).Decode(&m); err != nil {
+			return nil, err
+		}
+	case ".yaml", ".yml":
+		if err := yaml.NewDecoder(r).Decode(&m); err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+	case ".json":
+		dec := json.NewDecoder(r)
+		dec.UseNumber()
+		if err := dec.Decode(&m); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported config file format %q (use .toml, .yaml or .json)", ext)
+	}
+	return m, nil
+}
+
+// isFlag reports whether name is a flag of the root command or of any
+// subcommand.
+func (cl *configLoader) isFlag(name string) bool {
+	for _, cmd := range append([]*ff.Command{cl.root}, cl.root.Subcommands...) {
+		if _, ok := cmd.Flags.GetFlag(name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// parse is an ff.ConfigFileParseFunc. It runs for the root flag set and
+// again for the subcommand's, so unknown keys are caught here against every
+// command and ff skips those the flag set being parsed doesn't have.
+func (cl *configLoader) parse(r io.Reader, set func(name, value string) error) error {
+	m, err := cl.decode(r)
+	if err != nil {
+		return err
+	}
+
+	profiles, err := subtable(m, "profile")
+	if err != nil {
+		return err
+	}
+	delete(m, "profile")
+	sections := []map[string]any{m}
+	if *cl.profile != "" {
+		p, err := subtable(profiles, *cl.profile)
+		if err != nil {
+			return err
+		}
+		if p == nil {
+			return fmt.Errorf("no profile %q (have: %s)", *cl.profile, strings.Join(slices.Sorted(maps.Keys(profiles)), ", "))
+		}
+		sections = append(sections, p)
+	}
+
+	cl.overrides = nil
+	flags := make(map[string]any)
+	for _, s := range sections {
+		var overrides []overrideConfig
+		if err := convert(s["override"], &overrides); err != nil {
+			return fmt.Errorf("override: %w", err)
+		}
+		for i, oc := range overrides {
+			o, err := oc.override()
+			if err != nil {
+				return fmt.Errorf("override %d: %w", i+1, err)
+			}
+			cl.overrides = append(cl.overrides, o)
+		}
+		delete(s, "override")
+		maps.Copy(flags, s)
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(flags)) {
+		if !cl.isFlag(name) || name == "config" || name == "profile" {
+			return fmt.Errorf("%s: %w", name, ff.ErrUnknownFlag)
+		}
+		values, err := flagValues(flags[name])
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		for _, v := range values {
+			if err := set(name, v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// subtable returns m[key] as a table, nil if it isn't there.
+func subtable(m map[string]any, key string) (map[string]any, error) {
+	v, ok := m[key]
+	if !ok {
+		return nil, nil
+	}
+	s, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%s must be a table", key)
+	}
+	return s, nil
+}
+
+// convert decodes a generic config value into v, by way of JSON.
+func convert(value, v any) error {
+	if value == nil {
+		return nil
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// flagValues turns a config value into flag values, one for each element of
+// a list.
+func flagValues(value any) ([]string, error) {
+	switch v := value.(type) {
+	case string:
+		return []string{v}, nil
+	case bool:
+		return []string{strconv.FormatBool(v)}, nil
+	case int, int64, uint64, float64, json.Number:
+		return []string{fmt.Sprint(v)}, nil
+	case []any:
+		var values []string
+		for _, elem := range v {
+			if _, nested := elem.([]any); nested {
+				return nil, errors.New("lists can't be nested")
+			}
+			ev, err := flagValues(elem)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, ev...)
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("unsupported value %v", value)
+	}
+}
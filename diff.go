@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/markpash/heybabe/probe"
+	"github.com/peterbourgon/ff/v4"
+	"github.com/rodaine/table"
+)
+
+// testKey identifies a test against a target across runs. Addresses are
+// left out on purpose, DNS hands out different ones from run to run.
+type testKey struct {
+	target string
+	test   string
+}
+
+// testSummary is a test summed up over every address of a target.
+type testSummary struct {
+	successes int
+	attempts  int
+	// phases holds the durations of the successful attempts per phase, in
+	// the order of diffPhases.
+	phases [3][]time.Duration
+}
+
+var diffPhases = [3]string{"Transport", "TLS Handshake", "TTFB"}
+
+func (s *testSummary) status() string {
+	return resultStatus(s.successes, s.attempts)
+}
+
+// summarize sums up every test of a run, keeping the order they were run in.
+func summarize(report runReport) ([]testKey, map[testKey]*testSummary) {
+	var keys []testKey
+	summaries := make(map[testKey]*testSummary)
+	for _, tr := range report.Targets {
+		for _, result := range tr.Results {
+			key := testKey{target: fmt.Sprintf("%s:%d", tr.SNI, tr.Port), test: result.Test}
+			s, ok := summaries[key]
+			if !ok {
+				s = &testSummary{}
+				summaries[key] = s
+				keys = append(keys, key)
+			}
+			s.successes += result.Successes
+			s.attempts += len(result.Attempts)
+			for _, a := range result.Attempts {
+				if !a.Success {
+					continue
+				}
+				for i, v := range [3]float64{a.TransportMS, a.TLSHandshakeMS, a.TTFBMS} {
+					s.phases[i] = append(s.phases[i], time.Duration(v*float64(time.Millisecond)))
+				}
+			}
+		}
+	}
+	return keys, summaries
+}
+
+// diffRuns prints the tests whose status changed between two runs and the
+// phases whose median got slower by more than threshold percent and more
+// than minDelta.
+func diffRuns(w io.Writer, before, after historyEntry, threshold uint, minDelta time.Duration) {
+	headerFmt := color.New(color.FgHiMagenta, color.Bold, color.Underline).SprintfFunc()
+	columnFmt := color.New(color.FgHiCyan, color.Bold).SprintfFunc()
+	titleFmt := color.New(color.FgHiYellow, color.Bold).SprintfFunc()
+	worseFmt := color.New(color.FgHiRed, color.Bold).SprintfFunc()
+	betterFmt := color.New(color.FgHiGreen, color.Bold).SprintfFunc()
+
+	fmt.Fprintf(w, "Comparing %s (%s) with %s (%s)\n",
+		before.ID, before.Report.StartedAt.Local().Format(time.DateTime),
+		after.ID, after.Report.StartedAt.Local().Format(time.DateTime))
+
+	beforeKeys, beforeSummaries := summarize(before.Report)
+	afterKeys, afterSummaries := summarize(after.Report)
+
+	statusRank := map[string]int{"Failed": 0, "Partial": 1, "Success": 2}
+	statusTbl := table.New("Target", "Test", "Before", "After")
+	statusTbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt).WithWriter(w)
+	statusChanges := 0
+
+	latencyTbl := table.New("Target", "Test", "Phase", "Before", "After", "Change")
+	latencyTbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt).WithWriter(w)
+	regressions := 0
+
+	for _, key := range beforeKeys {
+		b := beforeSummaries[key]
+		a, ok := afterSummaries[key]
+		if !ok {
+			statusTbl.AddRow(key.target, key.test, fmt.Sprintf("%s (%d/%d)", b.status(), b.successes, b.attempts), "not run")
+			statusChanges++
+			continue
+		}
+
+		if b.status() != a.status() {
+			change := fmt.Sprintf("%s (%d/%d)", a.status(), a.successes, a.attempts)
+			if statusRank[a.status()] < statusRank[b.status()] {
+				change = worseFmt(change)
+			} else {
+				change = betterFmt(change)
+			}
+			statusTbl.AddRow(key.target, key.test, fmt.Sprintf("%s (%d/%d)", b.status(), b.successes, b.attempts), change)
+			statusChanges++
+		}
+
+		for i, phase := range diffPhases {
+			if len(b.phases[i]) == 0 || len(a.phases[i]) == 0 {
+				continue
+			}
+			bMedian := probe.NewLatencyStats(b.phases[i]).P50
+			aMedian := probe.NewLatencyStats(a.phases[i]).P50
+			delta := aMedian - bMedian
+			if bMedian == 0 || delta <= minDelta || float64(delta)/float64(bMedian)*100 <= float64(threshold) {
+				continue
+			}
+			latencyTbl.AddRow(key.target, key.test, phase,
+				fmt.Sprintf("%.1f ms", probe.Milliseconds(bMedian)),
+				fmt.Sprintf("%.1f ms", probe.Milliseconds(aMedian)),
+				worseFmt("+%.1f ms (+%.0f%%)", probe.Milliseconds(delta), float64(delta)/float64(bMedian)*100),
+			)
+			regressions++
+		}
+	}
+	for _, key := range afterKeys {
+		if _, ok := beforeSummaries[key]; !ok {
+			a := afterSummaries[key]
+			statusTbl.AddRow(key.target, key.test, "not run", fmt.Sprintf("%s (%d/%d)", a.status(), a.successes, a.attempts))
+			statusChanges++
+		}
+	}
+
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, titleFmt("Status changes:"))
+	if statusChanges == 0 {
+		fmt.Fprintln(w, "  none")
+	} else {
+		statusTbl.Print()
+	}
+
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, titleFmt("Latency regressions (median, more than %d%% and %s slower):", threshold, minDelta))
+	if regressions == 0 {
+		fmt.Fprintln(w, "  none")
+	} else {
+		latencyTbl.Print()
+	}
+}
+
+// newDiffCommand compares two runs from the history.
+func newDiffCommand(parent *ff.FlagSet, dataDir *string) *ff.Command {
+	fs := ff.NewFlagSet("diff").SetParent(parent)
+	threshold := fs.UintLong("threshold", 20, "report phases whose median got slower by more than this percentage")
+	minDelta := fs.DurationLong("min-delta", 5*time.Millisecond, "ignore latency changes smaller than this")
+
+	return &ff.Command{
+		Name:      "diff",
+		Usage:     appName + " diff [FLAGS] [<runA> <runB>]",
+		ShortHelp: "compare two recorded runs (default: previous and latest)",
+		LongHelp: "Runs are given by ID, a unique prefix of the ID, or as \"latest\" and\n" +
+			"\"previous\". See the history subcommand for the IDs.",
+		Flags: fs,
+		Exec: func(ctx context.Context, args []string) error {
+			refs := []string{"previous", "latest"}
+			switch len(args) {
+			case 0:
+			case 2:
+				refs = args
+			default:
+				return errors.New("diff takes either no runs or two runs")
+			}
+
+			dir, err := dataDirOrDefault(*dataDir)
+			if err != nil {
+				return err
+			}
+			entries, err := readHistory(dir)
+			if err != nil {
+				return err
+			}
+			before, err := findRun(entries, refs[0])
+			if err != nil {
+				return err
+			}
+			after, err := findRun(entries, refs[1])
+			if err != nil {
+				return err
+			}
+
+			diffRuns(os.Stdout, before, after, *threshold, *minDelta)
+			return nil
+		},
+	}
+}
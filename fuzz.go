@@ -0,0 +1,382 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/fatih/color"
+	"github.com/markpash/heybabe/probe"
+	"github.com/peterbourgon/ff/v4"
+	"github.com/rodaine/table"
+)
+
+// fuzzTarget holds the results of the hellos against one target. Features
+// depend on the SNI, so they are correlated per target.
+type fuzzTarget struct {
+	target  probe.Target
+	results []fuzzResult
+	// err is why no hello could run against the target.
+	err error
+}
+
+// fuzzResult is a generated hello summed up over every address of a target.
+type fuzzResult struct {
+	hello     probe.FuzzHello
+	label     string
+	features  []string
+	successes int
+	attempts  int
+	// failures holds the failed attempts, for the dominant failure.
+	failures []probe.AttemptResult
+}
+
+// featureStats counts the attempts of the hellos with and without a feature.
+type featureStats struct {
+	feature                   string
+	with, withSuccesses       int
+	without, withoutSuccesses int
+	withRate, withoutRate     float64
+}
+
+// fuzzHellos returns count hellos with consecutive seeds from seed. The mixed
+// generator cycles through the generators by seed.
+func fuzzHellos(generator, base string, seed uint64, count uint) []probe.FuzzHello {
+	hellos := make([]probe.FuzzHello, count)
+	for i := range hellos {
+		h := probe.FuzzHello{Generator: probe.FuzzGenerator(generator), Seed: seed + uint64(i)}
+		if generator == "mixed" {
+			h.Generator = probe.FuzzGenerators[h.Seed%uint64(len(probe.FuzzGenerators))]
+		}
+		if h.Generator == probe.FuzzMutate {
+			h.Base = base
+		}
+		hellos[i] = h
+	}
+	return hellos
+}
+
+// correlate returns the features only some of the hellos have, by how much
+// more often the attempts of the hellos with them got through than those
+// without, strongest first.
+func correlate(results []fuzzResult) []featureStats {
+	var features []string
+	for _, r := range results {
+		features = append(features, r.features...)
+	}
+	slices.Sort(features)
+	features = slices.Compact(features)
+
+	var stats []featureStats
+	for _, f := range features {
+		s := featureStats{feature: f}
+		for _, r := range results {
+			if slices.Contains(r.features, f) {
+				s.with += r.attempts
+				s.withSuccesses += r.successes
+			} else {
+				s.without += r.attempts
+				s.withoutSuccesses += r.successes
+			}
+		}
+		if s.with == 0 || s.without == 0 {
+			continue
+		}
+		s.withRate = float64(s.withSuccesses) / float64(s.with)
+		s.withoutRate = float64(s.withoutSuccesses) / float64(s.without)
+		stats = append(stats, s)
+	}
+	slices.SortStableFunc(stats, func(a, b featureStats) int {
+		return cmp.Compare(math.Abs(b.withRate-b.withoutRate), math.Abs(a.withRate-a.withoutRate))
+	})
+	return stats
+}
+
+// fuzzReport is the fuzz result in --output json, see SCHEMA.md.
+type fuzzReport struct {
+	SchemaVersion int                `json:"schema_version"`
+	Targets       []fuzzTargetReport `json:"targets"`
+}
+
+type fuzzTargetReport struct {
+	SNI      string              `json:"sni"`
+	Host     string              `json:"host"`
+	Port     uint16              `json:"port"`
+	Error    string              `json:"error,omitempty"`
+	Hellos   []fuzzHelloReport   `json:"hellos"`
+	Features []fuzzFeatureReport `json:"features"`
+}
+
+type fuzzHelloReport struct {
+	ID        string   `json:"id"`
+	Features  []string `json:"features"`
+	Successes int      `json:"successes"`
+	Attempts  int      `json:"attempts"`
+	Failure   string   `json:"failure,omitempty"`
+}
+
+type fuzzFeatureReport struct {
+	Feature          string `json:"feature"`
+	With             int    `json:"with"`
+	WithSuccesses    int    `json:"with_successes"`
+	Without          int    `json:"without"`
+	WithoutSuccesses int    `json:"without_successes"`
+}
+
+func newFuzzReport(targets []fuzzTarget) fuzzReport {
+	report := fuzzReport{SchemaVersion: resultsSchemaVersion, Targets: make([]fuzzTargetReport, 0, len(targets))}
+	for _, ft := range targets {
+		tr := fuzzTargetReport{
+			SNI:      ft.target.SNI,
+			Host:     ft.target.Host,
+			Port:     ft.target.Port,
+			Error:    errString(ft.err),
+			Hellos:   []fuzzHelloReport{},
+			Features: []fuzzFeatureReport{},
+		}
+		if ft.err == nil {
+			for _, r := range ft.results {
+				tr.Hellos = append(tr.Hellos, fuzzHelloReport{
+					ID:        r.hello.String(),
+					Features:  r.features,
+					Successes: r.successes,
+					Attempts:  r.attempts,
+					Failure:   dominantFailure(r.failures),
+				})
+			}
+			for _, s := range correlate(ft.results) {
+				tr.Features = append(tr.Features, fuzzFeatureReport{
+					Feature:          s.feature,
+					With:             s.with,
+					WithSuccesses:    s.withSuccesses,
+					Without:          s.without,
+					WithoutSuccesses: s.withoutSuccesses,
+				})
+			}
+		}
+		report.Targets = append(report.Targets, tr)
+	}
+	return report
+}
+
+// writeFuzzReport writes the fuzz result as a table or as JSON. top only
+// limits the features of the table.
+func writeFuzzReport(w io.Writer, format string, targets []fuzzTarget, top int) error {
+	switch format {
+	case "table":
+		printFuzzReport(w, targets, top)
+		return nil
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(newFuzzReport(targets))
+	default:
+		return fmt.Errorf("unknown fuzz output format %q", format)
+	}
+}
+
+// printFuzzReport prints, for every target, the result of every hello, then
+// the features that correlate with getting through.
+func printFuzzReport(w io.Writer, targets []fuzzTarget, top int) {
+	for _, ft := range targets {
+		printFuzzTarget(w, ft, top)
+	}
+	fmt.Fprintln(w)
+}
+
+func printFuzzTarget(w io.Writer, ft fuzzTarget, top int) {
+	headerFmt := color.New(color.FgHiMagenta, color.Bold, color.Underline).SprintfFunc()
+	columnFmt := color.New(color.FgHiCyan, color.Bold).SprintfFunc()
+	titleFmt := color.New(color.FgHiYellow, color.Bold).SprintfFunc()
+	worseFmt := color.New(color.FgHiRed, color.Bold).SprintFunc()
+	betterFmt := color.New(color.FgHiGreen, color.Bold).SprintFunc()
+
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, titleFmt("Target: %s (host %s, port %d)", ft.target.SNI, ft.target.Host, ft.target.Port))
+	if ft.err != nil {
+		fmt.Fprintf(w, "  %v\n", ft.err)
+		return
+	}
+	results := ft.results
+
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, titleFmt("ClientHellos:"))
+	tbl := table.New("Hello", "Handshake", "Failure")
+	tbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt).WithWriter(w)
+	for _, r := range results {
+		tbl.AddRow(r.hello, fmt.Sprintf("%s (%d/%d)", resultStatus(r.successes, r.attempts), r.successes, r.attempts), dominantFailure(r.failures))
+	}
+	tbl.Print()
+
+	stats := correlate(results)
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, titleFmt("Features by correlation with success:"))
+	if len(stats) == 0 {
+		fmt.Fprintln(w, "  none, every hello has the same features")
+		return
+	}
+	tbl = table.New("Feature", "With", "Without", "Change")
+	tbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt).WithWriter(w)
+	for _, s := range stats[:min(top, len(stats))] {
+		change := fmt.Sprintf("%+.0f%%", (s.withRate-s.withoutRate)*100)
+		switch {
+		case s.withRate < s.withoutRate:
+			change = worseFmt(change)
+		case s.withRate > s.withoutRate:
+			change = betterFmt(change)
+		}
+		tbl.AddRow(s.feature,
+			fmt.Sprintf("%.0f%% (%d/%d)", s.withRate*100, s.withSuccesses, s.with),
+			fmt.Sprintf("%.0f%% (%d/%d)", s.withoutRate*100, s.withoutSuccesses, s.without),
+			change,
+		)
+	}
+	tbl.Print()
+}
+
+// exportFuzzHellos writes a --hello-spec file for every hello that got
+// through on every attempt against every target.
+func exportFuzzHellos(dir string, targets []fuzzTarget) ([]string, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	var paths []string
+	for i, r := range targets[0].results {
+		if slices.ContainsFunc(targets, func(ft fuzzTarget) bool {
+			fr := ft.results[i]
+			return ft.err != nil || fr.attempts == 0 || fr.successes != fr.attempts
+		}) {
+			continue
+		}
+		spec, err := r.hello.ClientHelloSpec()
+		if err != nil {
+			return paths, fmt.Errorf("%s: %w", r.hello, err)
+		}
+		data, err := probe.MarshalHelloSpec("Fuzz "+r.hello.String(), spec)
+		if err != nil {
+			return paths, fmt.Errorf("%s: %w", r.hello, err)
+		}
+		path := filepath.Join(dir, strings.ReplaceAll(r.hello.String(), ":", "-")+".json")
+		if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+			return paths, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// runFuzz runs the hellos against the targets of the app and reports, for
+// every target, which features of them correlate with getting through.
+func runFuzz(ctx context.Context, a *app, hellos []probe.FuzzHello, top int, exportDir string) error {
+	to := a.to
+	to.Tests = nil
+	targets := make([]fuzzTarget, len(to.Targets))
+	for i, target := range to.Targets {
+		targets[i] = fuzzTarget{target: target, results: make([]fuzzResult, len(hellos))}
+	}
+	for j, h := range hellos {
+		spec, err := h.Spec()
+		if err != nil {
+			return err
+		}
+		for i := range targets {
+			features, err := h.Features(targets[i].target.SNI)
+			if err != nil {
+				return fmt.Errorf("%s: %w", h, err)
+			}
+			targets[i].results[j] = fuzzResult{hello: h, label: spec.Label, features: features}
+		}
+		to.Tests = append(to.Tests, probe.NewTest(spec))
+	}
+
+	run, err := probe.Run(ctx, to)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		return err
+	}
+	for i, tr := range run.Targets {
+		targets[i].err = tr.Err
+		for j := range targets[i].results {
+			r := &targets[i].results[j]
+			for _, testResult := range tr.Results[r.label] {
+				for _, attempt := range testResult.Attempts {
+					r.attempts++
+					if attempt.Err != nil {
+						r.failures = append(r.failures, attempt)
+						continue
+					}
+					r.successes++
+				}
+			}
+		}
+	}
+
+	if err := writeFuzzReport(a.out, a.output, targets, top); err != nil {
+		return fmt.Errorf("failed to write results: %w", err)
+	}
+	if exportDir != "" {
+		paths, err := exportFuzzHellos(exportDir, targets)
+		for _, path := range paths {
+			a.l.Info("exported ClientHello spec", "path", path)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to export: %w", err)
+		}
+	}
+	return nil
+}
+
+// newFuzzCommand runs randomized ClientHellos against the targets.
+func newFuzzCommand(parent *ff.FlagSet, a *app) *ff.Command {
+	generators := []string{"mixed"}
+	for _, g := range probe.FuzzGenerators {
+		generators = append(generators, string(g))
+	}
+
+	fs := ff.NewFlagSet("fuzz").SetParent(parent)
+	count := fs.UintLong("count", 20, "number of ClientHellos to generate")
+	seed := fs.Uint64Long("seed", 0, "seed of the first ClientHello, the next ones count up from it (0 picks a random one)")
+	generator := fs.StringEnumLong("generator", fmt.Sprintf("how to generate the ClientHellos (valid values: %s)", generators), generators...)
+	base := fs.StringLong("base", "Chrome_Auto", "fingerprint the mutate generator starts from")
+	top := fs.UintLong("top", 20, "number of features to show")
+	exportDir := fs.StringLong("export-dir", "", "write a --hello-spec file for every ClientHello that got through to this directory")
+
+	return &ff.Command{
+		Name:      "fuzz",
+		Usage:     appName + " fuzz [FLAGS]",
+		ShortHelp: "run randomized ClientHellos and report which features get through",
+		LongHelp: "Every ClientHello is named after its generator and seed, such as\n" +
+			"mutate:Chrome_Auto:42. Run it again with --fuzz-hello, or with --seed,\n" +
+			"--generator and --count 1 here.",
+		Flags: fs,
+		Exec: func(ctx context.Context, args []string) error {
+			if *count == 0 {
+				return errors.New("count must be at least 1")
+			}
+			if a.output != "table" && a.output != "json" {
+				return fmt.Errorf("fuzz can't write %s output, only table or json", a.output)
+			}
+			if *generator == "mixed" || *generator == string(probe.FuzzMutate) {
+				if _, err := probe.ParseFuzzHello(fmt.Sprintf("%s:%s:1", probe.FuzzMutate, *base)); err != nil {
+					return err
+				}
+			}
+			for *seed == 0 {
+				*seed = rand.Uint64()
+			}
+			a.l.Info("fuzzing", "seed", *seed, "count", *count, "generator", *generator)
+			return runFuzz(ctx, a, fuzzHellos(*generator, *base, *seed, *count), int(*top), *exportDir)
+		},
+	}
+}
@@ -7,11 +7,16 @@ toolchain go1.24.3
 require (
 	github.com/carlmjohnson/versioninfo v0.22.5
 	github.com/fatih/color v1.18.0
+	github.com/google/gopacket v1.1.19
+	github.com/pelletier/go-toml/v2 v2.0.9
 	github.com/peterbourgon/ff/v4 v4.0.0-alpha.4
 	github.com/refraction-networking/uquic v0.0.6
 	github.com/refraction-networking/utls v1.7.3
 	github.com/rodaine/table v1.3.0
+	golang.org/x/crypto v0.40.0
 	golang.org/x/crypto/x509roots/fallback v0.0.0-20250529171604-18228cd6f13e
+	golang.org/x/net v0.42.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -20,17 +25,14 @@ require (
 	github.com/gaukas/clienthellod v0.4.2 // indirect
 	github.com/gaukas/godicttls v0.0.4 // indirect
 	github.com/go-task/slim-sprig/v3 v3.0.0 // indirect
-	github.com/google/gopacket v1.1.19 // indirect
 	github.com/google/pprof v0.0.0-20240430035430-e4905b036c4e // indirect
 	github.com/klauspost/compress v1.17.8 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
 	github.com/onsi/ginkgo/v2 v2.17.2 // indirect
 	go.uber.org/mock v0.4.0 // indirect
-	golang.org/x/crypto v0.40.0 // indirect
 	golang.org/x/exp v0.0.0-20240416160154-fe59bbe5cc7f // indirect
 	golang.org/x/mod v0.25.0 // indirect
-	golang.org/x/net v0.42.0 // indirect
 	golang.org/x/sys v0.34.0 // indirect
 	golang.org/x/text v0.27.0 // indirect
 	golang.org/x/tools v0.34.0 // indirect
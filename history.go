@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/markpash/heybabe/probe"
+	"github.com/peterbourgon/ff/v4"
+	"github.com/rodaine/table"
+)
+
+// historyFile is the append-only log of runs in the data directory, one
+// historyEntry per line.
+const historyFile = "runs.jsonl"
+
+// historyEntry is a run as it is stored in the history.
+type historyEntry struct {
+	ID          string      `json:"id"`
+	Options     runOptions  `json:"options"`
+	Environment environment `json:"environment"`
+	Report      runReport   `json:"report"`
+}
+
+// runOptions are the options a run was made with. The targets are part of
+// the report.
+type runOptions struct {
+	Args             []string `json:"args"`
+	Profile          string   `json:"profile,omitempty"`
+	Tests            []string `json:"tests"`
+	Resolver         string   `json:"resolver"`
+	PoisonCheck      bool     `json:"poison_check"`
+	TrustedResolvers []string `json:"trusted_resolvers,omitempty"`
+	IPv4             bool     `json:"ipv4"`
+	IPv6             bool     `json:"ipv6"`
+	AllIPs           bool     `json:"all_ips"`
+	MaxIPs           uint     `json:"max_ips"`
+	Repeat           uint     `json:"repeat"`
+	Concurrency      uint     `json:"concurrency"`
+	DelayMS          float64  `json:"delay_ms"`
+	JitterMS         float64  `json:"jitter_ms"`
+	TimeoutMS        float64  `json:"timeout_ms"`
+	Interleave       bool     `json:"interleave"`
+	Insecure         bool     `json:"insecure"`
+	Proxy            string   `json:"proxy,omitempty"`
+	Source           string   `json:"source,omitempty"`
+}
+
+func newRunOptions(args []string, profile string, to probe.Options) runOptions {
+	opts := runOptions{
+		Args:        args,
+		Profile:     profile,
+		Resolver:    to.ResolverName,
+		PoisonCheck: to.PoisonCheck,
+		IPv4:        to.ResolveIPv4,
+		IPv6:        to.ResolveIPv6,
+		AllIPs:      to.AllIPs,
+		MaxIPs:      to.MaxIPs,
+		Repeat:      to.Repeat,
+		Concurrency: to.Concurrency,
+		DelayMS:     probe.Milliseconds(to.Delay),
+		JitterMS:    probe.Milliseconds(to.Jitter),
+		TimeoutMS:   probe.Milliseconds(to.Timeout),
+		Interleave:  to.Interleave,
+		Insecure:    to.Insecure,
+		Source:      to.Source.String(),
+	}
+	if to.Proxy != nil {
+		opts.Proxy = to.Proxy.String()
+	}
+	for _, tc := range to.Tests {
+		opts.Tests = append(opts.Tests, tc.Label)
+	}
+	for _, r := range to.TrustedResolvers {
+		opts.TrustedResolvers = append(opts.TrustedResolvers, r.Name)
+	}
+	return opts
+}
+
+// environment is where a run was made from.
+type environment struct {
+	Version   string `json:"version"`
+	GoVersion string `json:"go_version"`
+	OS        string `json:"os"`
+	Arch      string `json:"arch"`
+	Hostname  string `json:"hostname"`
+}
+
+func currentEnvironment() environment {
+	hostname, _ := os.Hostname()
+	return environment{
+		Version:   version,
+		GoVersion: runtime.Version(),
+		OS:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+		Hostname:  hostname,
+	}
+}
+
+// defaultDataDir is where the history is kept unless --data-dir is set.
+func defaultDataDir() (string, error) {
+	if dir := os.Getenv("XDG_DATA_HOME"); dir != "" {
+		return filepath.Join(dir, appName), nil
+	}
+	switch runtime.GOOS {
+	case "windows", "darwin", "ios", "plan9":
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(dir, appName), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".local", "share", appName), nil
+}
+
+func dataDirOrDefault(dir string) (string, error) {
+	if dir != "" {
+		return dir, nil
+	}
+	return defaultDataDir()
+}
+
+// runID names a run after when it started.
+func runID(startedAt time.Time) string {
+	return startedAt.UTC().Format("20060102-150405.000")
+}
+
+// appendHistory adds a run to the history in dir.
+func appendHistory(dir string, entry historyEntry) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, historyFile), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// recordRun adds a finished run to the history.
+func recordRun(dataDir string, args []string, profile string, to probe.Options, run probe.Report) error {
+	dir, err := dataDirOrDefault(dataDir)
+	if err != nil {
+		return err
+	}
+	return appendHistory(dir, historyEntry{
+		ID:          runID(run.StartedAt),
+		Options:     newRunOptions(args, profile, to),
+		Environment: currentEnvironment(),
+		Report:      newRunReport(run),
+	})
+}
+
+// readHistory returns every run in the history in dir, oldest first.
+func readHistory(dir string) ([]historyEntry, error) {
+	f, err := os.Open(filepath.Join(dir, historyFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []historyEntry
+	dec := json.NewDecoder(f)
+	for {
+		var entry historyEntry
+		err := dec.Decode(&entry)
+		if errors.Is(err, io.EOF) {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read history: %w", err)
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// findRun finds a run by "latest", "previous", its ID or a unique prefix of
+// its ID.
+func findRun(entries []historyEntry, ref string) (historyEntry, error) {
+	switch ref {
+	case "latest":
+		if len(entries) > 0 {
+			return entries[len(entries)-1], nil
+		}
+		return historyEntry{}, errors.New("history is empty")
+	case "previous":
+		if len(entries) > 1 {
+			return entries[len(entries)-2], nil
+		}
+		return historyEntry{}, errors.New("history has less than two runs")
+	}
+
+	var matches []historyEntry
+	for _, entry := range entries {
+		if entry.ID == ref {
+			return entry, nil
+		}
+		if strings.HasPrefix(entry.ID, ref) {
+			matches = append(matches, entry)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return historyEntry{}, fmt.Errorf("no run matches %q", ref)
+	case 1:
+		return matches[0], nil
+	default:
+		return historyEntry{}, fmt.Errorf("%d runs match %q", len(matches), ref)
+	}
+}
+
+// newHistoryCommand lists the runs in the history.
+func newHistoryCommand(parent *ff.FlagSet, dataDir *string) *ff.Command {
+	fs := ff.NewFlagSet("history").SetParent(parent)
+	limit := fs.UintLong("limit", 20, "number of most recent runs to list (0 means all)")
+
+	return &ff.Command{
+		Name:      "history",
+		Usage:     appName + " history [FLAGS]",
+		ShortHelp: "list recorded runs",
+		Flags:     fs,
+		Exec: func(ctx context.Context, args []string) error {
+			dir, err := dataDirOrDefault(*dataDir)
+			if err != nil {
+				return err
+			}
+			entries, err := readHistory(dir)
+			if err != nil {
+				return err
+			}
+			if *limit > 0 && len(entries) > int(*limit) {
+				entries = entries[len(entries)-int(*limit):]
+			}
+
+			headerFmt := color.New(color.FgHiMagenta, color.Bold, color.Underline).SprintfFunc()
+			columnFmt := color.New(color.FgHiCyan, color.Bold).SprintfFunc()
+			tbl := table.New("ID", "Started", "Targets", "Tests", "Successful attempts")
+			tbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt)
+			for _, entry := range entries {
+				var targets []string
+				var successes, attempts int
+				for _, tr := range entry.Report.Targets {
+					targets = append(targets, tr.SNI)
+					for _, result := range tr.Results {
+						successes += result.Successes
+						attempts += len(result.Attempts)
+					}
+				}
+				tbl.AddRow(
+					entry.ID,
+					entry.Report.StartedAt.Local().Format(time.DateTime),
+					strings.Join(targets, ", "),
+					len(entry.Options.Tests),
+					fmt.Sprintf("%d/%d", successes, attempts),
+				)
+			}
+			tbl.Print()
+			return nil
+		},
+	}
+}
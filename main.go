@@ -1,21 +1,39 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/netip"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/carlmjohnson/versioninfo"
+	"github.com/fatih/color"
+	"github.com/markpash/heybabe/probe"
 	"github.com/peterbourgon/ff/v4"
 	"github.com/peterbourgon/ff/v4/ffhelp"
+	"gopkg.in/yaml.v3"
 )
 
-const appName = "heybabe"
+const (
+	appName = "heybabe"
+
+	// defaultTrustedResolver is used by --poison-check when no trusted
+	// resolver is given.
+	defaultTrustedResolver = "https://cloudflare-dns.com/dns-query"
+)
 
 var (
 	version   = ""
@@ -27,6 +45,16 @@ var (
 	}
 )
 
+// app is what subcommands share once the flags are parsed.
+type app struct {
+	l  *slog.Logger
+	to probe.Options
+	// out is where results go, stdout or --output-file, in the --output
+	// format.
+	out    io.Writer
+	output string
+}
+
 func main() {
 	fs := ff.NewFlagSet(appName)
 	var (
@@ -36,26 +64,83 @@ func main() {
 		host     = fs.StringLong("host", "", "http host (defaults to sni)")
 		port     = fs.UintLong("port", 443, "tls port")
 		ip       = fs.StringLong("ip", "", "manually provide IP (no DNS lookup)")
+		targets  = fs.StringLong("targets", "", "file with one sni[,host][,ip][,port] target per line (- for stdin)")
+		target   = fs.StringListLong("target", "sni[,host][,ip][,port] target to test (repeatable)")
+		resolvr  = fs.StringLong("resolver", "", "dns resolver URL: udp://, tcp://, tls:// (DoT), https:// (DoH) or quic:// (DoQ) (default: system resolver)")
+		poison   = fs.BoolLong("poison-check", "compare the resolver's answers with trusted resolvers and test the addresses of both")
+		trusted  = fs.StringListLong("trusted-resolver", "trusted (encrypted) resolver URL for --poison-check (repeatable) (default: "+defaultTrustedResolver+")")
+		fprints  = fs.StringListLong("fingerprints", "also run the TCP or QUIC flow of every uTLS and uQUIC fingerprint matching (glob, or /regex/; repeatable; '*' for all)")
+		specs    = fs.StringListLong("hello-spec", "file with a ClientHello spec (JSON or YAML) to run as an extra test (repeatable)")
+		replays  = fs.StringListLong("replay-hello", "ClientHello to replay as an extra test: a pcap or pcapng file, a file of raw bytes or hex, or hex (repeatable)")
+		replSNI  = fs.StringLong("replay-sni", "", "from a capture, replay the ClientHello sent for this SNI instead of the first one")
+		fuzzIDs  = fs.StringListLong("fuzz-hello", "ClientHello of the fuzz subcommand to run again as an extra test, by its ID such as mutate:Chrome_Auto:42 (repeatable)")
+		echConf  = fs.StringLong("ech-config", "", "file with an ECHConfigList (raw or base64) for the ECH test, instead of the HTTPS DNS record")
+		proxy    = fs.StringLong("proxy", "", "run every test through this proxy: socks5://[user:pass@]host:port or http://[user:pass@]host:port (QUIC needs SOCKS5)")
+		srcIP    = fs.StringLong("source-ip", "", "local IP to send the tests from, to pick an uplink on multi-homed machines")
+		iface    = fs.StringLong("interface", "", "network interface to send the tests through (SO_BINDTODEVICE, Linux only)")
+		insecure = fs.BoolLong("insecure", "complete handshakes even if the certificate doesn't verify, to see what a middlebox presents")
+		allIPs   = fs.BoolLong("all-ips", "test every resolved address instead of the first of each family")
+		maxIPs   = fs.UintLong("max-ips", 0, "with --all-ips, the maximum number of addresses per family to test (0 means no limit)")
 		repeat   = fs.UintLong("repeat", 1, "number of times to repeat each test")
+		tests    = fs.StringListLong("tests", "only run tests whose label matches (glob, or /regex/; repeatable)")
+		skip     = fs.StringListLong("skip-tests", "skip tests whose label matches (glob, or /regex/; repeatable)")
+		list     = fs.BoolLong("list-tests", "list available tests and exit")
+		conc     = fs.UintLong("concurrency", 1, "number of test attempts to run at the same time")
+		delay    = fs.DurationLong("delay", 2*time.Second, "minimum time between attempts against the same destination")
+		jitter   = fs.DurationLong("jitter", 0, "random extra time added to each delay, up to this value")
+		timeout  = fs.DurationLong("timeout", 10*time.Second, "timeout for each test attempt")
+		interl   = fs.BoolLong("interleave", "run tests round-robin instead of all repeats of one test back to back")
+		output   = fs.StringEnumLong("output", fmt.Sprintf("results format (valid values: %s)", outputFormats), outputFormats...)
+		stats    = fs.BoolLong("stats", "show min, p50, p90, p99, max and standard deviation of each phase in the table")
+		outFile  = fs.StringLong("output-file", "", "write results to this file instead of stdout")
+		dataDir  = fs.StringLong("data-dir", "", "directory the run history is kept in (default: $XDG_DATA_HOME/heybabe or ~/.local/share/heybabe)")
+		noHist   = fs.BoolLong("no-history", "don't record this run in the history")
 		logLevel = fs.StringEnumLong("loglevel", fmt.Sprintf("specify a log level (valid values: %s)", logLevels), logLevels...)
 		logJson  = fs.Bool('j', "json", "log in json format")
+		config   = fs.StringLong("config", "", "read flags, test overrides and profiles from this TOML, YAML or JSON file")
+		profile  = fs.StringLong("profile", "", "apply this profile of the --config file")
 		verFlag  = fs.BoolLong("version", "displays version number")
 	)
 
-	err := ff.Parse(fs, os.Args[1:])
+	a := &app{}
+	monitorCmd := newMonitorCommand(fs, a)
+	fuzzCmd := newFuzzCommand(fs, a)
+	root := &ff.Command{
+		Name:  appName,
+		Usage: appName + " [FLAGS] [<SUBCOMMAND> [FLAGS]]",
+		Flags: fs,
+		Subcommands: []*ff.Command{
+			newHistoryCommand(fs, dataDir),
+			newDiffCommand(fs, dataDir),
+			monitorCmd,
+			fuzzCmd,
+			newServeAPICommand(fs, a),
+		},
+	}
+
+	cl := &configLoader{root: root, path: config, profile: profile}
+	err := root.Parse(os.Args[1:],
+		ff.WithEnvVarPrefix(envVarPrefix),
+		ff.WithConfigFileFlag("config"),
+		ff.WithConfigFileParser(cl.parse),
+		ff.WithConfigIgnoreUndefinedFlags(),
+	)
+	if err == nil && *profile != "" && *config == "" {
+		err = errors.New("--profile needs --config")
+	}
 	switch {
 	case errors.Is(err, ff.ErrHelp):
-		fmt.Fprintf(os.Stderr, "%s\n", ffhelp.Flags(fs))
+		fmt.Fprintf(os.Stderr, "%s\n", ffhelp.Command(root.GetSelected()))
 		os.Exit(0)
 	case err != nil:
 		fmt.Fprintf(os.Stderr, "error: %v\n", err)
 		os.Exit(1)
 	}
 
+	if version == "" {
+		version = versioninfo.Short()
+	}
 	if *verFlag {
-		if version == "" {
-			version = versioninfo.Short()
-		}
 		fmt.Fprintf(os.Stderr, "%s\n", version)
 		os.Exit(0)
 	}
@@ -74,55 +159,243 @@ func main() {
 
 	var lHandler slog.Handler
 	if *logJson {
-		lHandler = slog.NewJSONHandler(os.Stdout, lOpts)
+		lHandler = slog.NewJSONHandler(os.Stderr, lOpts)
 	} else {
-		lHandler = slog.NewTextHandler(os.Stdout, lOpts)
+		lHandler = slog.NewTextHandler(os.Stderr, lOpts)
 	}
 
 	l := slog.New(lHandler)
+	a.l = l
+
+	// Subcommands other than monitor and fuzz don't take the targets from
+	// the flags.
+	selectedCmd := root.GetSelected()
+	if selectedCmd != root && selectedCmd != monitorCmd && selectedCmd != fuzzCmd {
+		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer cancel()
+		if err := root.Run(ctx); err != nil {
+			fatal(l, err)
+		}
+		return
+	}
+	if args := fs.GetArgs(); selectedCmd == root && len(args) > 0 {
+		fatal(l, fmt.Errorf("unknown subcommand %q", args[0]))
+	}
+
+	suite := probe.Suite()
+	if len(*fprints) > 0 {
+		fingerprintTests, err := probe.FingerprintTests(*fprints)
+		if err != nil {
+			fatal(l, err)
+		}
+		suite = append(suite, fingerprintTests...)
+	}
+	for _, path := range *specs {
+		spec, err := readHelloSpecFile(path)
+		if err != nil {
+			fatal(l, err)
+		}
+		if suite, err = addTest(suite, spec); err != nil {
+			fatal(l, fmt.Errorf("%s: %w", path, err))
+		}
+	}
+	for i, value := range *replays {
+		spec, err := readReplayHello(value, *replSNI, i+1)
+		if err != nil {
+			fatal(l, err)
+		}
+		if suite, err = addTest(suite, spec); err != nil {
+			fatal(l, fmt.Errorf("%s: %w", value, err))
+		}
+	}
+	for _, id := range *fuzzIDs {
+		h, err := probe.ParseFuzzHello(id)
+		if err != nil {
+			fatal(l, err)
+		}
+		spec, err := h.Spec()
+		if err != nil {
+			fatal(l, err)
+		}
+		if suite, err = addTest(suite, spec); err != nil {
+			fatal(l, fmt.Errorf("%s: %w", id, err))
+		}
+	}
+
+	selected, err := probe.SelectTests(suite, *tests, *skip)
+	if err != nil {
+		fatal(l, err)
+	}
+	if selected, err = probe.ApplyOverrides(selected, cl.overrides); err != nil {
+		fatal(l, err)
+	}
+
+	if *list {
+		printTestList(selected)
+		os.Exit(0)
+	}
 
 	// Make sure that port does not exceed 65535
 	if *port > uint(^uint16(0)) {
 		fatal(l, fmt.Errorf("invalid port %v", *port))
 	}
 
-	if *sni == "" {
-		fatal(l, errors.New("must specify SNI"))
+	if *sni == "" && *targets == "" && len(*target) == 0 {
+		fatal(l, errors.New("must specify SNI or targets"))
 	}
-	if *host == "" {
-		*host = *sni
+
+	var targetList []probe.Target
+	if *sni != "" {
+		if *host == "" {
+			*host = *sni
+		}
+
+		t := probe.Target{SNI: *sni, Host: *host, ManualIP: netip.IPv4Unspecified(), Port: uint16(*port)}
+		if *ip != "" {
+			if *v4 || *v6 {
+				fatal(l, errors.New("cannot set ip and -4 or -6"))
+			}
+			addr, err := netip.ParseAddr(*ip)
+			if err != nil {
+				fatal(l, err)
+			}
+			t.ManualIP = addr.Unmap()
+		}
+		targetList = append(targetList, t)
+	} else if *ip != "" {
+		fatal(l, errors.New("ip can only be set together with sni"))
 	}
 
-	addr := netip.IPv4Unspecified()
-	if *ip != "" {
-		if *v4 || *v6 {
-			fatal(l, errors.New("cannot set ip and -4 or -6"))
+	for _, line := range *target {
+		t, err := probe.ParseTarget(line, uint16(*port))
+		if err != nil {
+			fatal(l, err)
 		}
-		addr, err = netip.ParseAddr(*ip)
+		targetList = append(targetList, t)
+	}
+
+	if *targets != "" {
+		fileTargets, err := probe.ReadTargetsFile(*targets, uint16(*port))
+		if err != nil {
+			fatal(l, fmt.Errorf("failed to read targets: %w", err))
+		}
+		targetList = append(targetList, fileTargets...)
+	}
+
+	resolver, err := probe.NewResolver(*resolvr)
+	if err != nil {
+		fatal(l, err)
+	}
+	resolverName := *resolvr
+	if resolverName == "" {
+		resolverName = "system"
+	}
+
+	var trustedResolvers []probe.NamedResolver
+	if *poison {
+		if len(*trusted) == 0 {
+			*trusted = []string{defaultTrustedResolver}
+		}
+		for _, spec := range *trusted {
+			r, err := probe.NewResolver(spec)
+			if err != nil {
+				fatal(l, err)
+			}
+			trustedResolvers = append(trustedResolvers, probe.NamedResolver{Name: spec, Resolver: r})
+		}
+	}
+
+	var out io.Writer = os.Stdout
+	if *outFile != "" {
+		f, err := os.Create(*outFile)
+		if err != nil {
+			fatal(l, err)
+		}
+		defer f.Close()
+		out = f
+		color.NoColor = true
+	}
+
+	var echConfigList []byte
+	if *echConf != "" {
+		echConfigList, err = readECHConfigFile(*echConf)
 		if err != nil {
 			fatal(l, err)
 		}
-	} else if *v4 == *v6 {
+	}
+
+	var upstream *probe.Proxy
+	if *proxy != "" {
+		upstream, err = probe.NewProxy(*proxy)
+		if err != nil {
+			fatal(l, err)
+		}
+	}
+
+	if *v4 == *v6 {
 		// Essentially doing XNOR to make sure that if they are both false
 		// or both true, just set them both true.
 		*v4, *v6 = true, true
 	}
 
+	source, err := probe.NewSourceBinding(*srcIP, *iface)
+	if err != nil {
+		fatal(l, err)
+	}
+	if *v4, *v6, err = source.Families(*v4, *v6); err != nil {
+		fatal(l, err)
+	}
+
+	to := probe.Options{
+		Logger:           l,
+		ResolveIPv4:      *v4,
+		ResolveIPv6:      *v6,
+		Targets:          targetList,
+		Resolver:         resolver,
+		ResolverName:     resolverName,
+		PoisonCheck:      *poison,
+		TrustedResolvers: trustedResolvers,
+		AllIPs:           *allIPs,
+		MaxIPs:           *maxIPs,
+		Repeat:           *repeat,
+		Tests:            selected,
+		Concurrency:      *conc,
+		Delay:            *delay,
+		Jitter:           *jitter,
+		Timeout:          *timeout,
+		Interleave:       *interl,
+		ECHConfigList:    echConfigList,
+		Insecure:         *insecure,
+		Proxy:            upstream,
+		Source:           source,
+	}
+	if err := to.Validate(); err != nil {
+		fatal(l, err)
+	}
+	a.to = to
+	a.out, a.output = out, *output
+
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	go func() {
 		defer cancel()
 
-		to := TestOptions{
-			ResolveIPv4: *v4,
-			ResolveIPv6: *v6,
-			ManualIP:    addr.Unmap(),
-			Port:        uint16(*port),
-			SNI:         *sni,
-			Host:        *host,
-			Repeat:      *repeat,
+		if selectedCmd == monitorCmd || selectedCmd == fuzzCmd {
+			if err := root.Run(ctx); err != nil {
+				fatal(l, err)
+			}
+			return
 		}
 
-		if err := runTests(ctx, l, to); err != nil {
+		run, err := probe.Run(ctx, to)
+		if err := writeResults(out, *output, run, *stats); err != nil {
+			fatal(l, fmt.Errorf("failed to write results: %w", err))
+		}
+		if !*noHist {
+			if err := recordRun(*dataDir, os.Args[1:], *profile, to, run); err != nil {
+				l.Warn("failed to record run in history", "error", err)
+			}
+		}
+		if err != nil {
 			fatal(l, err)
 		}
 	}()
@@ -134,3 +407,117 @@ func fatal(l *slog.Logger, err error) {
 	l.Error(err.Error())
 	os.Exit(1)
 }
+
+// addTest adds a test of spec to the suite, unless the suite already has a
+// test of the same name.
+func addTest(suite []probe.Test, spec probe.TestSpec) ([]probe.Test, error) {
+	if slices.ContainsFunc(suite, func(tc probe.Test) bool { return tc.Label == spec.Label }) {
+		return suite, fmt.Errorf("there is already a test named %q", spec.Label)
+	}
+	return append(suite, probe.NewTest(spec)), nil
+}
+
+// readECHConfigFile reads an ECHConfigList from a file, either raw or base64
+// encoded as it shows up in the ech= parameter of an HTTPS record.
+func readECHConfigFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data))); err == nil {
+		data = decoded
+	}
+	if _, err := probe.ECHPublicName(data); err != nil {
+		return nil, fmt.Errorf("invalid ECH config in %s: %w", path, err)
+	}
+	return data, nil
+}
+
+// readHelloSpecFile reads a ClientHello spec in the format of
+// probe.ParseHelloSpec, as JSON or as the same in YAML. The test is named
+// after the name key of the file, or the file itself.
+func readHelloSpecFile(path string) (probe.TestSpec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return probe.TestSpec{}, err
+	}
+	if ext := strings.ToLower(filepath.Ext(path)); ext == ".yaml" || ext == ".yml" {
+		var v any
+		if err := yaml.Unmarshal(data, &v); err != nil {
+			return probe.TestSpec{}, fmt.Errorf("%s: %w", path, err)
+		}
+		if data, err = json.Marshal(v); err != nil {
+			return probe.TestSpec{}, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	var named struct {
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(data, &named); err != nil {
+		return probe.TestSpec{}, fmt.Errorf("%s: %w", path, err)
+	}
+	if named.Name == "" {
+		named.Name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	spec, err := probe.ParseHelloSpec(named.Name+" - TCP - uTLS Custom", data)
+	if err != nil {
+		return probe.TestSpec{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return spec, nil
+}
+
+var hexSeparators = strings.NewReplacer(" ", "", "\t", "", "\r", "", "\n", "", ":", "")
+
+// decodeHex decodes hex as copied from Wireshark or a hex dump, with or
+// without separators.
+func decodeHex(s string) ([]byte, error) {
+	s = strings.TrimPrefix(hexSeparators.Replace(s), "0x")
+	if s == "" {
+		return nil, errors.New("empty hex")
+	}
+	return hex.DecodeString(s)
+}
+
+// readReplayHello reads the ClientHello of a --replay-hello value and
+// returns the test replaying it. From a capture it takes the first
+// ClientHello, or the first one sent for sni if set. n numbers tests given
+// as hex on the command line.
+func readReplayHello(value, sni string, n int) (probe.TestSpec, error) {
+	name := filepath.Base(value)
+	data, err := os.ReadFile(value)
+	if err != nil {
+		if _, hexErr := decodeHex(value); hexErr != nil {
+			return probe.TestSpec{}, err
+		}
+		data, name = []byte(value), fmt.Sprintf("hello %d", n)
+	}
+
+	var hello probe.CapturedHello
+	if hellos, err := probe.ReadCaptureHellos(bytes.NewReader(data)); err == nil {
+		i := slices.IndexFunc(hellos, func(h probe.CapturedHello) bool { return sni == "" || h.ServerName == sni })
+		switch {
+		case i < 0 && sni != "":
+			return probe.TestSpec{}, fmt.Errorf("%s: no ClientHello for %s in the capture", value, sni)
+		case i < 0:
+			return probe.TestSpec{}, fmt.Errorf("%s: no ClientHello in the capture", value)
+		}
+		hello = hellos[i]
+		if hello.ServerName != "" {
+			name += " " + hello.ServerName
+		}
+	} else {
+		if decoded, err := decodeHex(string(data)); err == nil {
+			data = decoded
+		}
+		if hello, err = probe.ParseClientHello(data); err != nil {
+			return probe.TestSpec{}, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	spec, err := probe.NewReplaySpec("Replay "+name+" - TCP - uTLS Custom", hello)
+	if err != nil {
+		return probe.TestSpec{}, fmt.Errorf("%s: %w", name, err)
+	}
+	return spec, nil
+}
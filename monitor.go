@@ -0,0 +1,250 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/markpash/heybabe/probe"
+	"github.com/peterbourgon/ff/v4"
+)
+
+// latencyBuckets are the upper bounds of the phase duration histograms, in
+// seconds.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// metricPhases are the phases with a duration histogram, in the order of
+// seriesState.phases.
+var metricPhases = [3]string{"transport", "tls_handshake", "ttfb"}
+
+// seriesKey identifies a test against one address of a target.
+type seriesKey struct {
+	test string
+	sni  string
+	port uint16
+	ip   string
+}
+
+type histogram struct {
+	// counts holds the observations per bucket, not cumulative, with the
+	// last one for +Inf.
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func (h *histogram) observe(v float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(latencyBuckets)+1)
+	}
+	i, _ := slices.BinarySearch(latencyBuckets, v)
+	h.counts[i]++
+	h.count++
+	h.sum += v
+}
+
+type seriesState struct {
+	attempts  uint64
+	successes uint64
+	// ratio is the success ratio of the latest run.
+	ratio float64
+	// lastError is the failure class of the latest attempt, or "none".
+	lastError string
+	phases    [3]histogram
+}
+
+// monitorMetrics accumulates the results of every run of the monitor and
+// serves them in the Prometheus text format.
+type monitorMetrics struct {
+	mu      sync.Mutex
+	series  map[seriesKey]*seriesState
+	runs    uint64
+	lastRun time.Time
+}
+
+func newMonitorMetrics() *monitorMetrics {
+	return &monitorMetrics{series: make(map[seriesKey]*seriesState)}
+}
+
+func (m *monitorMetrics) update(run probe.Report) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.runs++
+	m.lastRun = run.FinishedAt
+
+	for _, tr := range run.Targets {
+		for _, tc := range run.Tests {
+			for _, testResult := range tr.Results[tc.Label] {
+				key := seriesKey{test: tc.Label, sni: tr.Target.SNI, port: tr.Target.Port, ip: testResult.AddrPort.Addr().String()}
+				s, ok := m.series[key]
+				if !ok {
+					s = &seriesState{}
+					m.series[key] = s
+				}
+
+				var successes int
+				for _, attempt := range testResult.Attempts {
+					s.attempts++
+					if attempt.Err != nil {
+						s.lastError = string(attempt.ErrorClass)
+						continue
+					}
+					successes++
+					s.successes++
+					s.lastError = "none"
+					for i, d := range [3]time.Duration{attempt.TransportEstablishDuration, attempt.TLSHandshakeDuration, attempt.TTFBDuration} {
+						s.phases[i].observe(d.Seconds())
+					}
+				}
+				if len(testResult.Attempts) > 0 {
+					s.ratio = float64(successes) / float64(len(testResult.Attempts))
+				}
+			}
+		}
+	}
+}
+
+// escapeLabel escapes a label value for the text format.
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func (k seriesKey) labels(extra ...string) string {
+	labels := fmt.Sprintf(`test="%s",sni="%s",port="%d",ip="%s"`, escapeLabel(k.test), escapeLabel(k.sni), k.port, escapeLabel(k.ip))
+	for i := 0; i+1 < len(extra); i += 2 {
+		labels += fmt.Sprintf(`,%s="%s"`, extra[i], escapeLabel(extra[i+1]))
+	}
+	return labels
+}
+
+func (m *monitorMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.writeTo(w)
+}
+
+func (m *monitorMetrics) writeTo(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]seriesKey, 0, len(m.series))
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, func(a, b seriesKey) int {
+		return cmp.Or(cmp.Compare(a.sni, b.sni), cmp.Compare(a.port, b.port), cmp.Compare(a.test, b.test), cmp.Compare(a.ip, b.ip))
+	})
+
+	family := func(name, typ, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+
+	family("heybabe_runs_total", "counter", "Number of completed runs of the suite.")
+	fmt.Fprintf(w, "heybabe_runs_total %d\n", m.runs)
+	family("heybabe_last_run_timestamp_seconds", "gauge", "Time the latest run finished.")
+	fmt.Fprintf(w, "heybabe_last_run_timestamp_seconds %d\n", m.lastRun.Unix())
+
+	family("heybabe_attempts_total", "counter", "Number of test attempts.")
+	for _, k := range keys {
+		fmt.Fprintf(w, "heybabe_attempts_total{%s} %d\n", k.labels(), m.series[k].attempts)
+	}
+	family("heybabe_attempt_successes_total", "counter", "Number of successful test attempts.")
+	for _, k := range keys {
+		fmt.Fprintf(w, "heybabe_attempt_successes_total{%s} %d\n", k.labels(), m.series[k].successes)
+	}
+	family("heybabe_success_ratio", "gauge", "Ratio of successful attempts in the latest run.")
+	for _, k := range keys {
+		fmt.Fprintf(w, "heybabe_success_ratio{%s} %g\n", k.labels(), m.series[k].ratio)
+	}
+	family("heybabe_last_error_info", "gauge", "Failure class of the latest attempt, \"none\" if it succeeded.")
+	for _, k := range keys {
+		fmt.Fprintf(w, "heybabe_last_error_info{%s} 1\n", k.labels("class", m.series[k].lastError))
+	}
+
+	family("heybabe_phase_duration_seconds", "histogram", "Duration of each phase of successful attempts.")
+	for _, k := range keys {
+		for i, phase := range metricPhases {
+			h := m.series[k].phases[i]
+			var cumulative uint64
+			for b, le := range latencyBuckets {
+				if h.counts != nil {
+					cumulative += h.counts[b]
+				}
+				fmt.Fprintf(w, "heybabe_phase_duration_seconds_bucket{%s} %d\n", k.labels("phase", phase, "le", fmt.Sprint(le)), cumulative)
+			}
+			fmt.Fprintf(w, "heybabe_phase_duration_seconds_bucket{%s} %d\n", k.labels("phase", phase, "le", "+Inf"), h.count)
+			fmt.Fprintf(w, "heybabe_phase_duration_seconds_sum{%s} %g\n", k.labels("phase", phase), h.sum)
+			fmt.Fprintf(w, "heybabe_phase_duration_seconds_count{%s} %d\n", k.labels("phase", phase), h.count)
+		}
+	}
+}
+
+// runMonitor runs the suite every interval until ctx is done, and serves the
+// metrics on listen in the meantime.
+func runMonitor(ctx context.Context, a *app, listen string, interval time.Duration) error {
+	metrics := newMonitorMetrics()
+
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+			a.l.Error("metrics server failed", "error", err)
+		}
+	}()
+	defer srv.Close()
+	a.l.Info("serving metrics", "addr", "http://"+ln.Addr().String()+"/metrics")
+
+	for {
+		start := time.Now()
+		run, err := probe.Run(ctx, a.to)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			a.l.Error(err.Error())
+		}
+		metrics.update(run)
+		next := start.Add(interval)
+		a.l.Info("run finished", "next", next.Format(time.DateTime))
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(time.Until(next)):
+		}
+	}
+}
+
+// newMonitorCommand runs the suite on an interval and exposes the results as
+// Prometheus metrics.
+func newMonitorCommand(parent *ff.FlagSet, a *app) *ff.Command {
+	fs := ff.NewFlagSet("monitor").SetParent(parent)
+	interval := fs.DurationLong("interval", 5*time.Minute, "time between the start of one run and the next")
+	listen := fs.StringLong("listen", "localhost:9342", "address to serve /metrics on")
+
+	return &ff.Command{
+		Name:      "monitor",
+		Usage:     appName + " monitor [FLAGS]",
+		ShortHelp: "run the tests on an interval and serve Prometheus metrics",
+		Flags:     fs,
+		Exec: func(ctx context.Context, args []string) error {
+			if *interval <= 0 {
+				return errors.New("interval must be positive")
+			}
+			return runMonitor(ctx, a, *listen, *interval)
+		},
+	}
+}
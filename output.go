@@ -0,0 +1,401 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/markpash/heybabe/probe"
+)
+
+// resultsSchemaVersion is the version of the machine-readable output, see
+// SCHEMA.md. Bump it on any change that isn't a new optional field.
+const resultsSchemaVersion = 1
+
+// outputFormats are the values accepted by --output.
+var outputFormats = []string{"table", "json", "ndjson", "csv"}
+
+// writeResults writes the run in the given format. withStats only affects
+// the table, the other formats always have the distributions.
+func writeResults(w io.Writer, format string, run probe.Report, withStats bool) error {
+	switch format {
+	case "table":
+		for _, tr := range run.Targets {
+			printTable(w, run, tr, withStats)
+		}
+		_, err := fmt.Fprintln(w)
+		return err
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(newRunReport(run))
+	case "ndjson":
+		enc := json.NewEncoder(w)
+		for _, record := range newAttemptRecords(run) {
+			if err := enc.Encode(record); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "csv":
+		return writeCSV(w, run)
+	default:
+		return fmt.Errorf("unknown output format %q", format)
+	}
+}
+
+type runReport struct {
+	SchemaVersion int            `json:"schema_version"`
+	StartedAt     time.Time      `json:"started_at"`
+	FinishedAt    time.Time      `json:"finished_at"`
+	Proxy         string         `json:"proxy,omitempty"`
+	Source        string         `json:"source,omitempty"`
+	Targets       []targetReport `json:"targets"`
+}
+
+type targetReport struct {
+	SNI         string             `json:"sni"`
+	Host        string             `json:"host"`
+	Port        uint16             `json:"port"`
+	ManualIP    string             `json:"manual_ip,omitempty"`
+	Error       string             `json:"error,omitempty"`
+	PoisonCheck *poisonCheckReport `json:"poison_check,omitempty"`
+	Results     []testReport       `json:"results"`
+}
+
+type poisonCheckReport struct {
+	Verdict string `json:"verdict"`
+	// Answers holds the primary resolver's answer first, then the trusted
+	// resolvers' answers.
+	Answers    []dnsAnswerReport `json:"answers"`
+	Suspicious map[string]string `json:"suspicious,omitempty"`
+}
+
+type dnsAnswerReport struct {
+	Resolver   string   `json:"resolver"`
+	Trusted    bool     `json:"trusted"`
+	Addrs      []string `json:"addrs"`
+	DurationMS float64  `json:"duration_ms"`
+	Error      string   `json:"error,omitempty"`
+}
+
+type testReport struct {
+	Test         string           `json:"test"`
+	Transport    probe.Transport  `json:"transport"`
+	Library      probe.TLSLibrary `json:"library"`
+	Fingerprint  string           `json:"fingerprint"`
+	Addr         string           `json:"addr"`
+	SNI          string           `json:"sni"`
+	DNSResolveMS float64          `json:"dns_resolve_ms"`
+	DNSSources   []string         `json:"dns_sources,omitempty"`
+	Status       string           `json:"status"`
+	Successes    int              `json:"successes"`
+	Stats        statsReport      `json:"stats"`
+	Attempts     []attemptReport  `json:"attempts"`
+}
+
+// statsReport holds the latency distribution of each phase over the
+// successful attempts.
+type statsReport struct {
+	ProxyConnect latencyReport `json:"proxy_connect,omitzero"`
+	Transport    latencyReport `json:"transport"`
+	TLSHandshake latencyReport `json:"tls_handshake"`
+	TTFB         latencyReport `json:"ttfb"`
+}
+
+type latencyReport struct {
+	Count    int     `json:"count"`
+	MinMS    float64 `json:"min_ms"`
+	P50MS    float64 `json:"p50_ms"`
+	P90MS    float64 `json:"p90_ms"`
+	P99MS    float64 `json:"p99_ms"`
+	MaxMS    float64 `json:"max_ms"`
+	MeanMS   float64 `json:"mean_ms"`
+	StdDevMS float64 `json:"stddev_ms"`
+}
+
+func newLatencyReport(s probe.LatencyStats) latencyReport {
+	return latencyReport{
+		Count:    s.Count,
+		MinMS:    probe.Milliseconds(s.Min),
+		P50MS:    probe.Milliseconds(s.P50),
+		P90MS:    probe.Milliseconds(s.P90),
+		P99MS:    probe.Milliseconds(s.P99),
+		MaxMS:    probe.Milliseconds(s.Max),
+		MeanMS:   probe.Milliseconds(s.Mean),
+		StdDevMS: probe.Milliseconds(s.StdDev),
+	}
+}
+
+type attemptReport struct {
+	Attempt          int                     `json:"attempt"`
+	StartedAt        time.Time               `json:"started_at,omitzero"`
+	Success          bool                    `json:"success"`
+	ProxyConnectMS   float64                 `json:"proxy_connect_ms,omitempty"`
+	TransportMS      float64                 `json:"transport_ms"`
+	TLSHandshakeMS   float64                 `json:"tls_handshake_ms"`
+	TTFBMS           float64                 `json:"ttfb_ms"`
+	TLSVersion       string                  `json:"tls_version,omitempty"`
+	CipherSuite      string                  `json:"cipher_suite,omitempty"`
+	ALPN             string                  `json:"alpn,omitempty"`
+	Error            string                  `json:"error,omitempty"`
+	ErrorPhase       probe.ErrorPhase        `json:"error_phase,omitempty"`
+	ErrorClass       probe.ErrorClass        `json:"error_class,omitempty"`
+	TLSAlert         string                  `json:"tls_alert,omitempty"`
+	ECH              *probe.ECHResult        `json:"ech,omitempty"`
+	ClientHello      *probe.HelloFingerprint `json:"client_hello,omitempty"`
+	Certificates     []probe.CertInfo        `json:"certificates,omitempty"`
+	CertVerifyError  string                  `json:"cert_verify_error,omitempty"`
+	CertInterception string                  `json:"cert_interception,omitempty"`
+}
+
+// attemptRecord is a single NDJSON line, an attempt along with what it was
+// run against.
+type attemptRecord struct {
+	SchemaVersion int              `json:"schema_version"`
+	Target        string           `json:"target"`
+	Host          string           `json:"host"`
+	Port          uint16           `json:"port"`
+	TargetError   string           `json:"target_error,omitempty"`
+	Test          string           `json:"test,omitempty"`
+	Transport     probe.Transport  `json:"transport,omitempty"`
+	Library       probe.TLSLibrary `json:"library,omitempty"`
+	Fingerprint   string           `json:"fingerprint,omitempty"`
+	Addr          string           `json:"addr,omitempty"`
+	*attemptReport
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func newRunReport(run probe.Report) runReport {
+	report := runReport{
+		SchemaVersion: resultsSchemaVersion,
+		StartedAt:     run.StartedAt,
+		FinishedAt:    run.FinishedAt,
+		Proxy:         run.Proxy,
+		Source:        run.Source,
+		Targets:       make([]targetReport, 0, len(run.Targets)),
+	}
+	for _, tr := range run.Targets {
+		report.Targets = append(report.Targets, newTargetReport(tr, run.Tests))
+	}
+	return report
+}
+
+func newTargetReport(tr probe.TargetResult, tests []probe.Test) targetReport {
+	report := targetReport{
+		SNI:     tr.Target.SNI,
+		Host:    tr.Target.Host,
+		Port:    tr.Target.Port,
+		Error:   errString(tr.Err),
+		Results: []testReport{},
+	}
+	if tr.Target.HasManualIP() {
+		report.ManualIP = tr.Target.ManualIP.String()
+	}
+	if pc := tr.PoisonCheck; pc != nil {
+		report.PoisonCheck = &poisonCheckReport{Verdict: pc.Verdict}
+		for i, answer := range append([]probe.DNSAnswer{pc.Primary}, pc.Trusted...) {
+			ar := dnsAnswerReport{
+				Resolver:   answer.Resolver,
+				Trusted:    i > 0,
+				Addrs:      []string{},
+				DurationMS: probe.Milliseconds(answer.Duration),
+				Error:      errString(answer.Err),
+			}
+			for _, addr := range answer.Addrs() {
+				ar.Addrs = append(ar.Addrs, addr.String())
+			}
+			report.PoisonCheck.Answers = append(report.PoisonCheck.Answers, ar)
+		}
+		if len(pc.Suspicious) > 0 {
+			report.PoisonCheck.Suspicious = make(map[string]string)
+			for addr, reason := range pc.Suspicious {
+				report.PoisonCheck.Suspicious[addr.String()] = reason
+			}
+		}
+	}
+
+	for _, tc := range tests {
+		for _, testResult := range tr.Results[tc.Label] {
+			report.Results = append(report.Results, newTestReport(tc, testResult))
+		}
+	}
+	return report
+}
+
+func newTestReport(tc probe.Test, testResult probe.TestResult) testReport {
+	report := testReport{
+		Test:         tc.Label,
+		Transport:    tc.Spec.Transport,
+		Library:      tc.Spec.Library,
+		Fingerprint:  tc.Spec.Fingerprint(),
+		Addr:         testResult.AddrPort.String(),
+		SNI:          testResult.SNI,
+		DNSResolveMS: probe.Milliseconds(testResult.DNSResolveDuration),
+		DNSSources:   testResult.DNSSources,
+		Attempts:     make([]attemptReport, len(testResult.Attempts)),
+	}
+	for i, attempt := range testResult.Attempts {
+		report.Attempts[i] = newAttemptReport(i, attempt)
+		if attempt.Err == nil {
+			report.Successes++
+		}
+	}
+	report.Status = resultStatus(report.Successes, len(testResult.Attempts))
+
+	stats := probe.NewPhaseStats(testResult.Attempts)
+	report.Stats = statsReport{
+		ProxyConnect: newLatencyReport(stats.ProxyConnect),
+		Transport:    newLatencyReport(stats.Transport),
+		TLSHandshake: newLatencyReport(stats.TLSHandshake),
+		TTFB:         newLatencyReport(stats.TTFB),
+	}
+	return report
+}
+
+func newAttemptReport(i int, attempt probe.AttemptResult) attemptReport {
+	report := attemptReport{
+		Attempt:          i + 1,
+		StartedAt:        attempt.StartedAt,
+		Success:          attempt.Err == nil,
+		ProxyConnectMS:   probe.Milliseconds(attempt.ProxyConnectDuration),
+		TransportMS:      probe.Milliseconds(attempt.TransportEstablishDuration),
+		TLSHandshakeMS:   probe.Milliseconds(attempt.TLSHandshakeDuration),
+		TTFBMS:           probe.Milliseconds(attempt.TTFBDuration),
+		ALPN:             attempt.ALPN,
+		Error:            errString(attempt.Err),
+		ErrorPhase:       attempt.ErrorPhase,
+		ErrorClass:       attempt.ErrorClass,
+		TLSAlert:         attempt.TLSAlert,
+		ECH:              attempt.ECH,
+		ClientHello:      attempt.ClientHello,
+		Certificates:     attempt.Certificates,
+		CertVerifyError:  attempt.CertVerifyError,
+		CertInterception: attempt.CertInterception,
+	}
+	if attempt.TLSVersion != 0 {
+		report.TLSVersion = tls.VersionName(attempt.TLSVersion)
+	}
+	if attempt.CipherSuite != 0 {
+		report.CipherSuite = tls.CipherSuiteName(attempt.CipherSuite)
+	}
+	return report
+}
+
+// newAttemptRecords flattens the run into one record per attempt. Targets
+// that failed before any test could run get a single record with the error.
+func newAttemptRecords(run probe.Report) []attemptRecord {
+	var records []attemptRecord
+	for _, tr := range run.Targets {
+		target := attemptRecord{
+			SchemaVersion: resultsSchemaVersion,
+			Target:        tr.Target.SNI,
+			Host:          tr.Target.Host,
+			Port:          tr.Target.Port,
+		}
+		if tr.Err != nil {
+			target.TargetError = tr.Err.Error()
+			records = append(records, target)
+			continue
+		}
+
+		for _, tc := range run.Tests {
+			for _, testResult := range tr.Results[tc.Label] {
+				for i, attempt := range testResult.Attempts {
+					records = append(records, newAttemptRecord(tr.Target, tc, testResult.AddrPort, i, attempt))
+				}
+			}
+		}
+	}
+	return records
+}
+
+// newAttemptRecord is the record of a single attempt.
+func newAttemptRecord(target probe.Target, tc probe.Test, addrPort netip.AddrPort, i int, attempt probe.AttemptResult) attemptRecord {
+	report := newAttemptReport(i, attempt)
+	return attemptRecord{
+		SchemaVersion: resultsSchemaVersion,
+		Target:        target.SNI,
+		Host:          target.Host,
+		Port:          target.Port,
+		Test:          tc.Label,
+		Transport:     tc.Spec.Transport,
+		Library:       tc.Spec.Library,
+		Fingerprint:   tc.Spec.Fingerprint(),
+		Addr:          addrPort.String(),
+		attemptReport: &report,
+	}
+}
+
+var csvHeader = []string{
+	"schema_version", "target", "host", "port", "target_error",
+	"test", "transport", "library", "fingerprint", "addr",
+	"attempt", "started_at", "success",
+	"transport_ms", "tls_handshake_ms", "ttfb_ms",
+	"tls_version", "cipher_suite", "alpn",
+	"error_phase", "error_class", "tls_alert", "error",
+	"ech_accepted", "leaf_spki_sha256", "cert_verify_error",
+	"proxy_connect_ms",
+	"ja3", "ja3_hash", "ja4", "extensions",
+}
+
+// writeCSV writes one row per attempt, with the same columns as the NDJSON
+// records minus the nested objects.
+func writeCSV(w io.Writer, run probe.Report) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return err
+	}
+
+	formatMS := func(v float64) string { return strconv.FormatFloat(v, 'f', 3, 64) }
+	for _, r := range newAttemptRecords(run) {
+		row := []string{
+			strconv.Itoa(r.SchemaVersion), r.Target, r.Host, strconv.Itoa(int(r.Port)), r.TargetError,
+			r.Test, string(r.Transport), string(r.Library), r.Fingerprint, r.Addr,
+		}
+		if a := r.attemptReport; a != nil {
+			var startedAt, echAccepted, leafSPKI string
+			var hello probe.HelloFingerprint
+			if !a.StartedAt.IsZero() {
+				startedAt = a.StartedAt.Format(time.RFC3339Nano)
+			}
+			if a.ECH != nil {
+				echAccepted = strconv.FormatBool(a.ECH.Accepted)
+			}
+			if len(a.Certificates) > 0 {
+				leafSPKI = a.Certificates[0].SPKISHA256
+			}
+			if a.ClientHello != nil {
+				hello = *a.ClientHello
+			}
+			row = append(row,
+				strconv.Itoa(a.Attempt), startedAt, strconv.FormatBool(a.Success),
+				formatMS(a.TransportMS), formatMS(a.TLSHandshakeMS), formatMS(a.TTFBMS),
+				a.TLSVersion, a.CipherSuite, a.ALPN,
+				string(a.ErrorPhase), string(a.ErrorClass), a.TLSAlert, a.Error,
+				echAccepted, leafSPKI, a.CertVerifyError,
+				formatMS(a.ProxyConnectMS),
+				hello.JA3, hello.JA3Hash, hello.JA4, hello.Extensions,
+			)
+		} else {
+			row = append(row, make([]string, len(csvHeader)-len(row))...)
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
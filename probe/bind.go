@@ -0,0 +1,110 @@
+package probe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"runtime"
+	"syscall"
+)
+
+// SourceBinding is where the connections of the tests originate from, a
+// local address, a network interface or both.
+type SourceBinding struct {
+	// IP is the local address to bind to, the zero Addr for any.
+	IP netip.Addr
+	// Interface is the network interface to send through, empty for the
+	// one the routing table picks.
+	Interface string
+}
+
+// NewSourceBinding checks the source IP and interface, either of which may
+// be empty.
+func NewSourceBinding(ip, iface string) (SourceBinding, error) {
+	var b SourceBinding
+	if ip != "" {
+		addr, err := netip.ParseAddr(ip)
+		if err != nil {
+			return SourceBinding{}, fmt.Errorf("invalid source IP: %w", err)
+		}
+		b.IP = addr.Unmap()
+	}
+	if iface != "" {
+		if runtime.GOOS != "linux" {
+			return SourceBinding{}, errors.New("--interface is only supported on Linux")
+		}
+		if _, err := net.InterfaceByName(iface); err != nil {
+			return SourceBinding{}, fmt.Errorf("invalid interface %q: %w", iface, err)
+		}
+		b.Interface = iface
+	}
+	return b, nil
+}
+
+// String describes the binding for the output, or is empty if unset.
+func (b SourceBinding) String() string {
+	switch {
+	case b.IP.IsValid() && b.Interface != "":
+		return b.IP.String() + "%" + b.Interface
+	case b.IP.IsValid():
+		return b.IP.String()
+	default:
+		return b.Interface
+	}
+}
+
+// Families narrows the address families to resolve down to the one of the
+// source IP, the only one that can be reached from it.
+func (b SourceBinding) Families(v4, v6 bool) (bool, bool, error) {
+	if !b.IP.IsValid() {
+		return v4, v6, nil
+	}
+	v4, v6 = v4 && b.IP.Is4(), v6 && b.IP.Is6()
+	if !v4 && !v6 {
+		return false, false, fmt.Errorf("source IP %s is not of the address family selected with -4 or -6", b.IP)
+	}
+	return v4, v6, nil
+}
+
+// applyTo binds the dialer.
+func (b SourceBinding) applyTo(d *net.Dialer) {
+	if b.IP.IsValid() {
+		d.LocalAddr = net.TCPAddrFromAddrPort(netip.AddrPortFrom(b.IP, 0))
+	}
+	d.Control = b.control
+}
+
+// control binds a socket to the interface before it is connected.
+func (b SourceBinding) control(network, address string, c syscall.RawConn) error {
+	if b.Interface == "" {
+		return nil
+	}
+	var bindErr error
+	err := c.Control(func(fd uintptr) {
+		bindErr = bindToDevice(fd, b.Interface)
+	})
+	if err != nil {
+		return err
+	}
+	return bindErr
+}
+
+// listenUDP opens a UDP socket to talk to dst from.
+func (b SourceBinding) listenUDP(ctx context.Context, dst netip.Addr) (*net.UDPConn, error) {
+	network, local := "udp4", "0.0.0.0:0"
+	if dst.Unmap().Is6() {
+		network, local = "udp6", "[::]:0"
+	}
+	if b.IP.IsValid() {
+		local = netip.AddrPortFrom(b.IP, 0).String()
+	}
+
+	lc := net.ListenConfig{Control: b.control}
+	conn, err := lc.ListenPacket(ctx, network, local)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
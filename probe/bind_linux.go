@@ -0,0 +1,9 @@
+package probe
+
+import "syscall"
+
+// bindToDevice sets SO_BINDTODEVICE, which needs CAP_NET_RAW on kernels
+// before 5.7.
+func bindToDevice(fd uintptr, iface string) error {
+	return syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface)
+}
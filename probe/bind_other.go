@@ -0,0 +1,10 @@
+//go:build !linux
+
+package probe
+
+import "errors"
+
+// bindToDevice is unsupported, NewSourceBinding rejects --interface first.
+func bindToDevice(fd uintptr, iface string) error {
+	return errors.New("binding to an interface is only supported on Linux")
+}
@@ -0,0 +1,118 @@
+package probe
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// CertInfo is what we keep of a certificate the server presented.
+type CertInfo struct {
+	Subject   string    `json:"subject"`
+	SANs      []string  `json:"sans"`
+	Issuer    string    `json:"issuer"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	// SPKISHA256 is the base64 SHA-256 of the SubjectPublicKeyInfo, the
+	// same value used for HPKP style pinning.
+	SPKISHA256 string `json:"spki_sha256"`
+	SelfSigned bool   `json:"self_signed"`
+}
+
+func newCertInfo(c *x509.Certificate) CertInfo {
+	spki := sha256.Sum256(c.RawSubjectPublicKeyInfo)
+
+	sans := append([]string{}, c.DNSNames...)
+	for _, ip := range c.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+
+	return CertInfo{
+		Subject:    c.Subject.String(),
+		SANs:       sans,
+		Issuer:     c.Issuer.String(),
+		NotBefore:  c.NotBefore,
+		NotAfter:   c.NotAfter,
+		SPKISHA256: base64.StdEncoding.EncodeToString(spki[:]),
+		SelfSigned: bytes.Equal(c.RawIssuer, c.RawSubject) && c.CheckSignatureFrom(c) == nil,
+	}
+}
+
+// peerCertificates returns the chain the server presented, from the
+// connection state or, if verification failed, from the error.
+func peerCertificates(conn any, handshakeErr error) []*x509.Certificate {
+	var (
+		verr  *tls.CertificateVerificationError
+		uverr *utls.CertificateVerificationError
+	)
+	switch {
+	case errors.As(handshakeErr, &verr):
+		return verr.UnverifiedCertificates
+	case errors.As(handshakeErr, &uverr):
+		return uverr.UnverifiedCertificates
+	case handshakeErr != nil:
+		return nil
+	}
+
+	switch c := conn.(type) {
+	case *tls.Conn:
+		return c.ConnectionState().PeerCertificates
+	case *utls.UConn:
+		return c.ConnectionState().PeerCertificates
+	}
+	return nil
+}
+
+// verifyChain verifies a chain the way crypto/tls would have, for attempts
+// that skipped verification with --insecure.
+func verifyChain(certs []*x509.Certificate, sni string) error {
+	if len(certs) == 0 {
+		return errors.New("no certificates presented")
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, c := range certs[1:] {
+		intermediates.AddCert(c)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		DNSName:       sni,
+		Intermediates: intermediates,
+	})
+	return err
+}
+
+// recordCertificates stores the chain of an attempt, and whether and how it
+// failed to verify.
+func (res *AttemptResult) recordCertificates(certs []*x509.Certificate, sni string, insecure bool, handshakeErr error) {
+	if len(certs) == 0 {
+		return
+	}
+
+	res.Certificates = make([]CertInfo, len(certs))
+	for i, c := range certs {
+		res.Certificates[i] = newCertInfo(c)
+	}
+
+	verifyErr := handshakeErr
+	if insecure && handshakeErr == nil {
+		verifyErr = verifyChain(certs, sni)
+	}
+	if verifyErr == nil || !isCertificateError(verifyErr) {
+		return
+	}
+	res.CertVerifyError = verifyErr.Error()
+
+	var unknownAuthority x509.UnknownAuthorityError
+	switch {
+	case res.Certificates[0].SelfSigned:
+		res.CertInterception = "self-signed certificate"
+	case errors.As(verifyErr, &unknownAuthority):
+		res.CertInterception = "unknown issuer " + res.Certificates[len(certs)-1].Issuer
+	}
+}
@@ -0,0 +1,238 @@
+package probe
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"syscall"
+
+	quic "github.com/refraction-networking/uquic"
+	utls "github.com/refraction-networking/utls"
+)
+
+// ErrorPhase is the step of an attempt a failure happened in.
+type ErrorPhase string
+
+const (
+	PhaseDNS       ErrorPhase = "dns"
+	PhaseProxy     ErrorPhase = "proxy"
+	PhaseTransport ErrorPhase = "transport"
+	PhaseTLS       ErrorPhase = "tls"
+	PhaseHTTP      ErrorPhase = "http"
+)
+
+// ErrorClass is our best guess at the cause of a failure. It is what tells
+// "blocked by SNI filtering" apart from "server is down".
+type ErrorClass string
+
+const (
+	ClassDNSFailure            ErrorClass = "dns_failure"
+	ClassProxyError            ErrorClass = "proxy_error"
+	ClassTCPTimeout            ErrorClass = "tcp_timeout"
+	ClassTCPReset              ErrorClass = "tcp_reset"
+	ClassTCPRefused            ErrorClass = "tcp_refused"
+	ClassUnreachable           ErrorClass = "unreachable"
+	ClassResetAfterClientHello ErrorClass = "reset_after_client_hello"
+	ClassEOFAfterClientHello   ErrorClass = "eof_after_client_hello"
+	ClassServerHelloTimeout    ErrorClass = "server_hello_timeout"
+	ClassHandshakeReset        ErrorClass = "handshake_reset"
+	ClassHandshakeEOF          ErrorClass = "handshake_eof"
+	ClassHandshakeTimeout      ErrorClass = "handshake_timeout"
+	ClassQUICTimeout           ErrorClass = "quic_timeout"
+	ClassTLSAlert              ErrorClass = "tls_alert"
+	ClassCertificate           ErrorClass = "certificate_error"
+	ClassECHRejected           ErrorClass = "ech_rejected"
+	ClassTLSError              ErrorClass = "tls_error"
+	ClassHTTPError             ErrorClass = "http_error"
+	ClassCanceled              ErrorClass = "canceled"
+	ClassOther                 ErrorClass = "other"
+)
+
+// tlsAlertNames are the TLS alert descriptions from the IANA registry.
+var tlsAlertNames = map[uint8]string{
+	0:   "close_notify",
+	10:  "unexpected_message",
+	20:  "bad_record_mac",
+	21:  "decryption_failed",
+	22:  "record_overflow",
+	30:  "decompression_failure",
+	40:  "handshake_failure",
+	41:  "no_certificate",
+	42:  "bad_certificate",
+	43:  "unsupported_certificate",
+	44:  "certificate_revoked",
+	45:  "certificate_expired",
+	46:  "certificate_unknown",
+	47:  "illegal_parameter",
+	48:  "unknown_ca",
+	49:  "access_denied",
+	50:  "decode_error",
+	51:  "decrypt_error",
+	60:  "export_restriction",
+	70:  "protocol_version",
+	71:  "insufficient_security",
+	80:  "internal_error",
+	86:  "inappropriate_fallback",
+	90:  "user_canceled",
+	100: "no_renegotiation",
+	109: "missing_extension",
+	110: "unsupported_extension",
+	111: "certificate_unobtainable",
+	112: "unrecognized_name",
+	113: "bad_certificate_status_response",
+	114: "bad_certificate_hash_value",
+	115: "unknown_psk_identity",
+	116: "certificate_required",
+	120: "no_application_protocol",
+	121: "ech_required",
+}
+
+// tlsAlertName decodes an alert code, e.g. "handshake_failure (40)".
+func tlsAlertName(code uint8) string {
+	name, ok := tlsAlertNames[code]
+	if !ok {
+		name = "unknown"
+	}
+	return fmt.Sprintf("%s (%d)", name, code)
+}
+
+// receivedAlert returns the alert the server sent, if err is one. Both
+// crypto/tls and uTLS report them as a net.OpError with the "remote error"
+// op, wrapping their unexported uint8 alert type. uQUIC reports them as
+// remote crypto errors.
+func receivedAlert(err error) (uint8, bool) {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "remote error" && opErr.Err != nil {
+		if v := reflect.ValueOf(opErr.Err); v.Kind() == reflect.Uint8 {
+			return uint8(v.Uint()), true
+		}
+	}
+
+	var quicErr *quic.TransportError
+	if errors.As(err, &quicErr) && quicErr.Remote && quicErr.ErrorCode.IsCryptoError() {
+		return uint8(quicErr.ErrorCode - 0x100), true
+	}
+
+	return 0, false
+}
+
+func isCertificateError(err error) bool {
+	var (
+		unknownAuthority x509.UnknownAuthorityError
+		hostname         x509.HostnameError
+		invalid          x509.CertificateInvalidError
+		verification     *tls.CertificateVerificationError
+		uverification    *utls.CertificateVerificationError
+	)
+	return errors.As(err, &unknownAuthority) ||
+		errors.As(err, &hostname) ||
+		errors.As(err, &invalid) ||
+		errors.As(err, &verification) ||
+		errors.As(err, &uverification)
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, os.ErrDeadlineExceeded) ||
+		(errors.As(err, &netErr) && netErr.Timeout())
+}
+
+func isEOF(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// classifyError works out the class of a failure from the phase it happened
+// in and the error. serverBytes is the number of bytes received from the
+// server before the failure, which tells apart a handshake that never got a
+// reply from one that broke halfway.
+func classifyError(phase ErrorPhase, err error, serverBytes int64) (ErrorClass, string) {
+	if errors.Is(err, context.Canceled) {
+		return ClassCanceled, ""
+	}
+	if code, ok := receivedAlert(err); ok {
+		return ClassTLSAlert, tlsAlertName(code)
+	}
+	var (
+		echErr  *tls.ECHRejectionError
+		uechErr *utls.ECHRejectionError
+	)
+	if errors.As(err, &echErr) || errors.As(err, &uechErr) {
+		return ClassECHRejected, ""
+	}
+	if isCertificateError(err) {
+		return ClassCertificate, ""
+	}
+
+	switch phase {
+	case PhaseDNS:
+		return ClassDNSFailure, ""
+	case PhaseProxy:
+		return ClassProxyError, ""
+	case PhaseTransport:
+		var (
+			idle      *quic.IdleTimeoutError
+			handshake *quic.HandshakeTimeoutError
+		)
+		switch {
+		case errors.As(err, &idle) || errors.As(err, &handshake):
+			return ClassQUICTimeout, ""
+		case isTimeout(err):
+			return ClassTCPTimeout, ""
+		case errors.Is(err, syscall.ECONNRESET):
+			return ClassTCPReset, ""
+		case errors.Is(err, syscall.ECONNREFUSED):
+			return ClassTCPRefused, ""
+		case errors.Is(err, syscall.EHOSTUNREACH) || errors.Is(err, syscall.ENETUNREACH):
+			return ClassUnreachable, ""
+		}
+	case PhaseTLS:
+		switch {
+		case errors.Is(err, syscall.ECONNRESET) && serverBytes == 0:
+			return ClassResetAfterClientHello, ""
+		case errors.Is(err, syscall.ECONNRESET):
+			return ClassHandshakeReset, ""
+		case isEOF(err) && serverBytes == 0:
+			return ClassEOFAfterClientHello, ""
+		case isEOF(err):
+			return ClassHandshakeEOF, ""
+		case isTimeout(err) && serverBytes == 0:
+			return ClassServerHelloTimeout, ""
+		case isTimeout(err):
+			return ClassHandshakeTimeout, ""
+		default:
+			return ClassTLSError, ""
+		}
+	case PhaseHTTP:
+		return ClassHTTPError, ""
+	}
+
+	return ClassOther, ""
+}
+
+// SetError records a failed attempt along with its classification.
+// serverBytes is the number of bytes received from the server before the
+// failure, see classifyError.
+func (res *AttemptResult) SetError(phase ErrorPhase, err error, serverBytes int64) {
+	res.Err = err
+	res.ErrorPhase = phase
+	res.ErrorClass, res.TLSAlert = classifyError(phase, err, serverBytes)
+}
+
+// countingConn counts the bytes received from the server, see classifyError.
+type countingConn struct {
+	net.Conn
+	read int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.read += int64(n)
+	return n, err
+}
@@ -0,0 +1,42 @@
+package probe
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+func TestClassifyError(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		phase       ErrorPhase
+		err         error
+		serverBytes int64
+		want        ErrorClass
+	}{
+		{"crypto/tls ECH rejection", PhaseTLS, &tls.ECHRejectionError{}, 100, ClassECHRejected},
+		{"uTLS ECH rejection", PhaseTLS, &utls.ECHRejectionError{}, 100, ClassECHRejected},
+		{"wrapped uTLS ECH rejection", PhaseTLS, fmt.Errorf("handshake: %w", &utls.ECHRejectionError{RetryConfigList: []byte{0}}), 100, ClassECHRejected},
+		{"canceled", PhaseTLS, context.Canceled, 0, ClassCanceled},
+		{"reset after the ClientHello", PhaseTLS, syscall.ECONNRESET, 0, ClassResetAfterClientHello},
+		{"reset during the handshake", PhaseTLS, syscall.ECONNRESET, 100, ClassHandshakeReset},
+		{"EOF after the ClientHello", PhaseTLS, io.EOF, 0, ClassEOFAfterClientHello},
+		{"ServerHello timeout", PhaseTLS, os.ErrDeadlineExceeded, 0, ClassServerHelloTimeout},
+		{"other TLS error", PhaseTLS, errors.New("tls: bad record MAC"), 100, ClassTLSError},
+		{"TCP refused", PhaseTransport, syscall.ECONNREFUSED, 0, ClassTCPRefused},
+		{"DNS failure", PhaseDNS, errors.New("no such host"), 0, ClassDNSFailure},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got, _ := classifyError(tc.phase, tc.err, tc.serverBytes); got != tc.want {
+				t.Errorf("classifyError = %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,11 @@
+// Package probe runs the heybabe tests: TLS and QUIC handshakes with
+// different libraries and ClientHello fingerprints against a set of targets,
+// timing each phase and classifying failures.
+//
+//	opts := probe.DefaultOptions()
+//	opts.Targets = []probe.Target{{SNI: "example.com", Host: "example.com", Port: 443}}
+//	report, err := probe.Run(ctx, opts)
+//
+// Custom tests are added with Register, or by putting them in
+// Options.Tests.
+package probe
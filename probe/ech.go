@@ -0,0 +1,291 @@
+package probe
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"os"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// dnsTypeHTTPS is the HTTPS resource record type (RFC 9460), which
+	// dnsmessage doesn't know about.
+	dnsTypeHTTPS dnsmessage.Type = 65
+	// svcParamECH is the SvcParamKey of the ECHConfigList.
+	svcParamECH uint16 = 5
+	// echConfigVersion is the ECHConfig version of the final draft.
+	echConfigVersion uint16 = 0xfe0d
+)
+
+// ECHResult is what an ECH test learned about the server.
+type ECHResult struct {
+	// Accepted is true if the server decrypted the inner ClientHello.
+	Accepted bool `json:"accepted"`
+	// OuterSNI is the public name sent in the outer ClientHello.
+	OuterSNI string `json:"outer_sni"`
+	// RetryConfigs is true if the server rejected ECH and sent back a new
+	// ECHConfigList to retry with.
+	RetryConfigs bool `json:"retry_configs"`
+}
+
+// ECHPublicName returns the public name of the first ECHConfig with a
+// version we understand, which is the SNI of the outer ClientHello.
+func ECHPublicName(list []byte) (string, error) {
+	if len(list) < 2 || int(binary.BigEndian.Uint16(list)) != len(list)-2 {
+		return "", errors.New("malformed ECHConfigList")
+	}
+	configs := list[2:]
+
+	for len(configs) >= 4 {
+		version := binary.BigEndian.Uint16(configs)
+		length := int(binary.BigEndian.Uint16(configs[2:]))
+		if len(configs) < 4+length {
+			return "", errors.New("malformed ECHConfig")
+		}
+		contents := configs[4 : 4+length]
+		configs = configs[4+length:]
+
+		if version != echConfigVersion {
+			continue
+		}
+
+		// config_id(1) kem_id(2) public_key<2> cipher_suites<2>
+		// maximum_name_length(1) public_name<1> extensions<2>
+		if len(contents) < 5 {
+			return "", errors.New("malformed ECHConfig")
+		}
+		rest := contents[3:]
+		for i := 0; i < 2; i++ {
+			if len(rest) < 2 || len(rest) < 2+int(binary.BigEndian.Uint16(rest)) {
+				return "", errors.New("malformed ECHConfig")
+			}
+			rest = rest[2+int(binary.BigEndian.Uint16(rest)):]
+		}
+		if len(rest) < 2 || len(rest) < 2+int(rest[1]) {
+			return "", errors.New("malformed ECHConfig")
+		}
+		return string(rest[2 : 2+int(rest[1])]), nil
+	}
+
+	return "", errors.New("no supported ECHConfig found")
+}
+
+// lookupECHConfigList fetches the ECHConfigList from the HTTPS record of the
+// target, following one alias if the record is in AliasMode.
+func lookupECHConfigList(ctx context.Context, r *net.Resolver, sni string, port uint16) ([]byte, error) {
+	name := sni
+	if port != 443 {
+		name = fmt.Sprintf("_%d._https.%s", port, sni)
+	}
+
+	for range 2 {
+		records, err := lookupHTTPS(ctx, r, name)
+		if err != nil {
+			return nil, err
+		}
+
+		alias := ""
+		for _, rr := range records {
+			if rr.priority == 0 {
+				alias = rr.target
+				continue
+			}
+			if ech, ok := rr.params[svcParamECH]; ok {
+				return ech, nil
+			}
+		}
+		if alias == "" || alias == "." {
+			break
+		}
+		name = alias
+	}
+
+	return nil, fmt.Errorf("no ECH config published for %s", sni)
+}
+
+// httpsRecord is a parsed HTTPS (SVCB) resource record.
+type httpsRecord struct {
+	priority uint16
+	target   string
+	params   map[uint16][]byte
+}
+
+// lookupHTTPS queries the HTTPS records of name through r. The Go resolver
+// can't ask for arbitrary types, so this builds the query by hand and sends
+// it over the resolver's Dial hook.
+func lookupHTTPS(ctx context.Context, r *net.Resolver, name string) ([]httpsRecord, error) {
+	qname, err := dnsmessage.NewName(strings.TrimSuffix(name, ".") + ".")
+	if err != nil {
+		return nil, err
+	}
+
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: uint16(rand.N(1 << 16)), RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: qname, Type: dnsTypeHTTPS, Class: dnsmessage.ClassINET}},
+	}
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := dnsExchange(ctx, r, packed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query HTTPS record of %s: %w", name, err)
+	}
+
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil {
+		return nil, err
+	}
+	if msg.ID != query.ID {
+		return nil, errors.New("dns response id mismatch")
+	}
+	if msg.RCode != dnsmessage.RCodeSuccess {
+		return nil, fmt.Errorf("failed to query HTTPS record of %s: %s", name, msg.RCode)
+	}
+
+	var records []httpsRecord
+	for _, answer := range msg.Answers {
+		body, ok := answer.Body.(*dnsmessage.UnknownResource)
+		if !ok || answer.Header.Type != dnsTypeHTTPS {
+			continue
+		}
+		rr, err := parseHTTPSRecord(body.Data)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, rr)
+	}
+
+	return records, nil
+}
+
+// parseHTTPSRecord parses the RDATA of an HTTPS record. The target name is
+// never compressed (RFC 9460 section 2.2).
+func parseHTTPSRecord(data []byte) (httpsRecord, error) {
+	errMalformed := errors.New("malformed HTTPS record")
+	if len(data) < 3 {
+		return httpsRecord{}, errMalformed
+	}
+	rr := httpsRecord{priority: binary.BigEndian.Uint16(data), params: make(map[uint16][]byte)}
+	data = data[2:]
+
+	var labels []string
+	for {
+		if len(data) < 1 || len(data) < 1+int(data[0]) {
+			return httpsRecord{}, errMalformed
+		}
+		n := int(data[0])
+		label := data[1 : 1+n]
+		data = data[1+n:]
+		if n == 0 {
+			break
+		}
+		labels = append(labels, string(label))
+	}
+	rr.target = strings.Join(labels, ".") + "."
+
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return httpsRecord{}, errMalformed
+		}
+		key := binary.BigEndian.Uint16(data)
+		n := int(binary.BigEndian.Uint16(data[2:]))
+		if len(data) < 4+n {
+			return httpsRecord{}, errMalformed
+		}
+		rr.params[key] = data[4 : 4+n]
+		data = data[4+n:]
+	}
+
+	return rr, nil
+}
+
+// dnsExchange sends a raw DNS message through the resolver's Dial hook, or to
+// the first system nameserver if the resolver has none.
+func dnsExchange(ctx context.Context, r *net.Resolver, msg []byte) ([]byte, error) {
+	dial := r.Dial
+	if dial == nil {
+		var d net.Dialer
+		dial = func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return d.DialContext(ctx, network, systemNameserver())
+		}
+	}
+
+	conn, err := dial(ctx, "udp", "")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if dl, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(dl)
+	}
+
+	if _, ok := conn.(net.PacketConn); ok {
+		if _, err := conn.Write(msg); err != nil {
+			return nil, err
+		}
+		resp := make([]byte, 0xffff)
+		n, err := conn.Read(resp)
+		if err != nil {
+			return nil, err
+		}
+		// Retry truncated answers over a stream connection.
+		if n < 3 || resp[2]&0x02 == 0 {
+			return resp[:n], nil
+		}
+		conn.Close()
+		if conn, err = dial(ctx, "tcp", ""); err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		if _, ok := conn.(net.PacketConn); ok {
+			return nil, errors.New("truncated DNS answer and the resolver can't retry over TCP")
+		}
+		if dl, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(dl)
+		}
+	}
+
+	query := binary.BigEndian.AppendUint16(nil, uint16(len(msg)))
+	if _, err := conn.Write(append(query, msg...)); err != nil {
+		return nil, err
+	}
+	var n [2]byte
+	if _, err := io.ReadFull(conn, n[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(n[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// systemNameserver returns the first nameserver from /etc/resolv.conf.
+func systemNameserver() string {
+	const fallback = "127.0.0.1:53"
+
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return fallback
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53")
+		}
+	}
+	return fallback
+}
@@ -0,0 +1,403 @@
+package probe
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	// This is for systems that don't have a good set of roots. (update often)
+	_ "golang.org/x/crypto/x509roots/fallback"
+
+	"github.com/markpash/heybabe/bepass/tlsfrag"
+	quic "github.com/refraction-networking/uquic"
+	utls "github.com/refraction-networking/utls"
+)
+
+// Transport is the protocol a test establishes before the TLS handshake.
+type Transport string
+
+const (
+	TransportTCP  Transport = "TCP"
+	TransportQUIC Transport = "QUIC"
+)
+
+// TLSLibrary is the TLS stack that drives the handshake.
+type TLSLibrary string
+
+const (
+	LibraryCryptoTLS TLSLibrary = "crypto/tls"
+	LibraryUTLS      TLSLibrary = "uTLS"
+	LibraryUQUIC     TLSLibrary = "uQUIC"
+)
+
+// FragmentOptions are the bepass fragmentation ranges, see tlsfrag.Adapter
+// for what each of them means.
+type FragmentOptions struct {
+	BeforeSNI [2]int
+	SNI       [2]int
+	AfterSNI  [2]int
+	Delay     [2]int
+}
+
+// TestSpec describes a single test as data. The engine runs it, so adding a
+// new combination is a matter of adding an entry to testMatrix, or of
+// registering NewTest(spec) from outside the package.
+type TestSpec struct {
+	Label     string
+	Transport Transport
+	Library   TLSLibrary
+
+	// ClientHelloID is the uTLS fingerprint, only used with LibraryUTLS.
+	ClientHelloID utls.ClientHelloID
+	// ClientHelloSpec builds a hand-written ClientHello for the given SNI.
+	// Only used with LibraryUTLS and utls.HelloCustom.
+	ClientHelloSpec func(sni string) (*utls.ClientHelloSpec, error)
+	// QUICID is the uQUIC fingerprint, only used with LibraryUQUIC.
+	QUICID quic.QUICID
+
+	// MinVersion and MaxVersion bound the TLS version, zero means the
+	// library default.
+	MinVersion uint16
+	MaxVersion uint16
+	// ALPN sets the config NextProtos. uTLS fingerprints carry their own
+	// ALPN extension which takes precedence.
+	ALPN []string
+
+	// Fragment enables the bepass fragmenting connection when set.
+	Fragment *FragmentOptions
+
+	// ECH offers Encrypted Client Hello with the target's ECHConfigList.
+	// Supported with LibraryCryptoTLS and LibraryUTLS, where the
+	// fingerprint's ClientHello is the outer one. Attempts of uQUIC tests
+	// with ECH fail, uQUIC can't encrypt the ClientHello.
+	ECH bool
+}
+
+// Fingerprint returns a short description of the ClientHello the test sends.
+func (s TestSpec) Fingerprint() string {
+	switch s.Library {
+	case LibraryUTLS:
+		return s.ClientHelloID.Str()
+	case LibraryUQUIC:
+		return s.QUICID.Client + "-" + s.QUICID.Version
+	default:
+		return "Go default"
+	}
+}
+
+// handshaker is satisfied by both *tls.Conn and *utls.UConn.
+type handshaker interface {
+	net.Conn
+	HandshakeContext(context.Context) error
+}
+
+// Run runs a single attempt of the test, it is the TestFunc of the spec.
+func (s TestSpec) Run(ctx context.Context, l *slog.Logger, p AttemptParams) AttemptResult {
+	l = l.With("test", s.Label, "ip", p.AddrPort.Addr().String())
+
+	switch s.Transport {
+	case TransportTCP:
+		return s.runTCP(ctx, l, p)
+	case TransportQUIC:
+		return s.runQUIC(ctx, l, p)
+	default:
+		res := AttemptResult{}
+		err := fmt.Errorf("unsupported transport %q", s.Transport)
+		l.Error(err.Error())
+		res.SetError(PhaseTransport, err, 0)
+		return res
+	}
+}
+
+func (s TestSpec) runTCP(ctx context.Context, l *slog.Logger, p AttemptParams) AttemptResult {
+	res := AttemptResult{}
+
+	tcpConn, err := p.DialTCP(ctx, &res)
+	if err != nil {
+		l.Error(err.Error())
+		return res
+	}
+	defer tcpConn.Close()
+
+	counter := &countingConn{Conn: tcpConn}
+	var conn net.Conn = counter
+	if f := s.Fragment; f != nil {
+		conn = tlsfrag.New(counter, f.BeforeSNI, f.SNI, f.AfterSNI, f.Delay)
+	}
+
+	if s.ECH {
+		if p.ECHConfigErr != nil {
+			l.Error(p.ECHConfigErr.Error())
+			res.SetError(PhaseDNS, p.ECHConfigErr, 0)
+			return res
+		}
+		outerSNI, err := ECHPublicName(p.ECHConfigList)
+		if err != nil {
+			l.Error(err.Error())
+			res.SetError(PhaseTLS, err, 0)
+			return res
+		}
+		res.ECH = &ECHResult{OuterSNI: outerSNI}
+	}
+
+	// The ClientHello is recorded above the fragmenting connection, which
+	// splits it over several writes.
+	recorder := &helloRecorder{Conn: conn}
+	tlsConn, err := s.tlsClient(recorder, p)
+	if err != nil {
+		l.Error(err.Error())
+		res.SetError(PhaseTLS, err, 0)
+		return res
+	}
+	defer tlsConn.Close()
+
+	// Explicitly run the handshake
+	t0 := time.Now()
+	err = tlsConn.HandshakeContext(ctx)
+	if hello, helloErr := recorder.fingerprint(); helloErr != nil {
+		l.Debug("no ClientHello fingerprint", "err", helloErr)
+	} else {
+		res.ClientHello = hello
+	}
+	res.recordCertificates(peerCertificates(tlsConn, err), p.SNI, p.Insecure, err)
+	if err != nil {
+		var echErr *tls.ECHRejectionError
+		var uechErr *utls.ECHRejectionError
+		switch {
+		case res.ECH == nil:
+		case errors.As(err, &echErr):
+			res.ECH.RetryConfigs = len(echErr.RetryConfigList) > 0
+		case errors.As(err, &uechErr):
+			res.ECH.RetryConfigs = len(uechErr.RetryConfigList) > 0
+		}
+		l.Error(err.Error())
+		res.SetError(PhaseTLS, err, counter.read)
+		return res
+	}
+	res.TLSHandshakeDuration = time.Since(t0)
+
+	switch c := tlsConn.(type) {
+	case *tls.Conn:
+		cs := c.ConnectionState()
+		res.TLSVersion, res.CipherSuite, res.ALPN = cs.Version, cs.CipherSuite, cs.NegotiatedProtocol
+		if res.ECH != nil {
+			res.ECH.Accepted = cs.ECHAccepted
+		}
+	case *utls.UConn:
+		cs := c.ConnectionState()
+		res.TLSVersion, res.CipherSuite, res.ALPN = cs.Version, cs.CipherSuite, cs.NegotiatedProtocol
+		if res.ECH != nil {
+			res.ECH.Accepted = cs.ECHAccepted
+		}
+	}
+	// uTLS offers the versions of its fingerprint whatever the config says.
+	if s.MinVersion != 0 && res.TLSVersion < s.MinVersion {
+		err := fmt.Errorf("negotiated %s, below the minimum of %s", tls.VersionName(res.TLSVersion), tls.VersionName(s.MinVersion))
+		l.Error(err.Error())
+		res.SetError(PhaseTLS, err, counter.read)
+		return res
+	}
+
+	l.Info("handshake success")
+
+	ttfb, err := MeasureTTFB(ctx, tlsConn, p.Host)
+	if err != nil {
+		res.SetError(PhaseHTTP, err, counter.read)
+		l.Error(err.Error())
+	}
+	res.TTFBDuration = ttfb
+
+	return res
+}
+
+// newTCPDialer returns the dialer for connections to the target or the proxy.
+func newTCPDialer(p AttemptParams) *net.Dialer {
+	d := &net.Dialer{
+		Timeout:       5 * time.Second,
+		FallbackDelay: -1, // disable happy-eyeballs
+		KeepAlive:     15, // default
+		Resolver:      p.Resolver,
+	}
+	d.SetMultipathTCP(false)
+	p.Source.applyTo(d)
+	return d
+}
+
+// DialTCP connects to the target, through the proxy and from the source if
+// set, and records the durations or the error in res. Custom tests use it to
+// measure the same way the built-in ones do.
+func (p AttemptParams) DialTCP(ctx context.Context, res *AttemptResult) (net.Conn, error) {
+	d := newTCPDialer(p)
+
+	if p.Proxy == nil {
+		t0 := time.Now()
+		conn, err := d.DialContext(ctx, "tcp", p.AddrPort.String())
+		if err != nil {
+			res.SetError(PhaseTransport, err, 0)
+			return nil, err
+		}
+		res.TransportEstablishDuration = time.Since(t0)
+		return conn, nil
+	}
+
+	t0 := time.Now()
+	proxyConn, err := p.Proxy.dial(ctx, d)
+	if err != nil {
+		res.SetError(PhaseProxy, err, 0)
+		return nil, err
+	}
+	res.ProxyConnectDuration = time.Since(t0)
+
+	t0 = time.Now()
+	conn, err := p.Proxy.connect(ctx, proxyConn, p.AddrPort)
+	if err != nil {
+		proxyConn.Close()
+		res.SetError(PhaseTransport, err, 0)
+		return nil, err
+	}
+	res.TransportEstablishDuration = time.Since(t0)
+	return conn, nil
+}
+
+// tlsClient wraps conn in the TLS client described by the spec.
+func (s TestSpec) tlsClient(conn net.Conn, p AttemptParams) (handshaker, error) {
+	if s.ECH && s.Library != LibraryCryptoTLS && s.Library != LibraryUTLS {
+		return nil, fmt.Errorf("ECH is not supported with %s", s.Library)
+	}
+
+	switch s.Library {
+	case LibraryCryptoTLS:
+		config := &tls.Config{
+			ServerName:         p.SNI,
+			InsecureSkipVerify: p.Insecure,
+			MinVersion:         s.MinVersion,
+			MaxVersion:         s.MaxVersion,
+			NextProtos:         s.ALPN,
+		}
+		if s.ECH {
+			config.EncryptedClientHelloConfigList = p.ECHConfigList
+		}
+		return tls.Client(conn, config), nil
+	case LibraryUTLS:
+		config := &utls.Config{
+			ServerName:         p.SNI,
+			InsecureSkipVerify: p.Insecure,
+			MinVersion:         s.MinVersion,
+			MaxVersion:         s.MaxVersion,
+			NextProtos:         s.ALPN,
+			// The probe never resumes a session, so the PSK fingerprints
+			// would otherwise fail on their empty pre_shared_key.
+			OmitEmptyPsk: true,
+		}
+		if s.ECH {
+			// The GREASE ECH extension of the fingerprint carries the
+			// real one.
+			config.EncryptedClientHelloConfigList = p.ECHConfigList
+		}
+		uConn := utls.UClient(conn, config, s.ClientHelloID)
+		if s.ClientHelloSpec != nil {
+			spec, err := s.ClientHelloSpec(p.SNI)
+			if err != nil {
+				return nil, fmt.Errorf("failed to build ClientHello: %w", err)
+			}
+			if err := uConn.ApplyPreset(spec); err != nil {
+				return nil, err
+			}
+		}
+		return uConn, nil
+	default:
+		return nil, fmt.Errorf("%s cannot be used over %s", s.Library, s.Transport)
+	}
+}
+
+func (s TestSpec) runQUIC(ctx context.Context, l *slog.Logger, p AttemptParams) AttemptResult {
+	res := AttemptResult{}
+
+	if s.Library != LibraryUQUIC {
+		err := fmt.Errorf("%s cannot be used over %s", s.Library, s.Transport)
+		l.Error(err.Error())
+		res.SetError(PhaseTransport, err, 0)
+		return res
+	}
+	if s.ECH {
+		err := fmt.Errorf("ECH is not supported with %s", s.Library)
+		l.Error(err.Error())
+		res.SetError(PhaseTLS, err, 0)
+		return res
+	}
+
+	tlsConfig := utls.Config{
+		ServerName:         p.SNI,
+		InsecureSkipVerify: p.Insecure,
+		MinVersion:         s.MinVersion,
+		MaxVersion:         s.MaxVersion,
+		NextProtos:         s.ALPN,
+	}
+
+	quicConf := &quic.Config{}
+
+	var udpConn net.PacketConn
+	if p.Proxy != nil {
+		t0 := time.Now()
+		assoc, err := p.Proxy.associate(ctx, newTCPDialer(p), p.Source)
+		if err != nil {
+			l.Error(err.Error())
+			res.SetError(PhaseProxy, err, 0)
+			return res
+		}
+		res.ProxyConnectDuration = time.Since(t0)
+		udpConn = assoc
+	} else {
+		conn, err := p.Source.listenUDP(ctx, p.AddrPort.Addr())
+		if err != nil {
+			l.Error(err.Error())
+			res.SetError(PhaseTransport, err, 0)
+			return res
+		}
+		udpConn = conn
+	}
+	defer udpConn.Close()
+
+	quicSpec, err := quic.QUICID2Spec(s.QUICID)
+	if err != nil {
+		l.Error(err.Error())
+		res.SetError(PhaseTLS, err, 0)
+		return res
+	}
+
+	recorder := &initialRecorder{PacketConn: udpConn}
+	ut := &quic.UTransport{
+		Transport: &quic.Transport{Conn: recorder},
+		QUICSpec:  &quicSpec,
+	}
+
+	t0 := time.Now()
+	quicConn, err := ut.Dial(ctx, net.UDPAddrFromAddrPort(p.AddrPort), &tlsConfig, quicConf)
+	if hello, helloErr := recorder.fingerprint(); helloErr != nil {
+		l.Debug("no ClientHello fingerprint", "err", helloErr)
+	} else {
+		res.ClientHello = hello
+	}
+	if err != nil {
+		res.recordCertificates(peerCertificates(nil, err), p.SNI, p.Insecure, err)
+		l.Error(err.Error())
+		// The QUIC handshake includes TLS, which is why the transport and
+		// TLS phases can't be told apart here.
+		res.SetError(PhaseTransport, err, 0)
+		return res
+	}
+	defer quicConn.CloseWithError(quic.ApplicationErrorCode(quic.NoError), "")
+	res.TransportEstablishDuration = time.Since(t0)
+	cs := quicConn.ConnectionState().TLS
+	res.TLSVersion, res.CipherSuite, res.ALPN = cs.Version, cs.CipherSuite, cs.NegotiatedProtocol
+	res.recordCertificates(cs.PeerCertificates, p.SNI, p.Insecure, nil)
+
+	l.Info("handshake success", "handshake", cs.HandshakeComplete)
+	l.Warn("TTFB test not yet implemented for QUIC")
+
+	return res
+}
@@ -0,0 +1,200 @@
+package probe
+
+import (
+	"crypto/tls"
+	"fmt"
+	"slices"
+	"strings"
+
+	quic "github.com/refraction-networking/uquic"
+	utls "github.com/refraction-networking/utls"
+)
+
+// Fingerprint is a client identity of the catalog, a uTLS ClientHelloID for
+// TCP or a uQUIC QUICID for QUIC.
+type Fingerprint struct {
+	// Name is the utls or uquic variable name without the Hello or QUIC
+	// prefix.
+	Name          string
+	Transport     Transport
+	ClientHelloID utls.ClientHelloID
+	QUICID        quic.QUICID
+}
+
+func tcpFingerprint(name string, id utls.ClientHelloID) Fingerprint {
+	return Fingerprint{Name: name, Transport: TransportTCP, ClientHelloID: id}
+}
+
+func quicFingerprint(name string, id quic.QUICID) Fingerprint {
+	return Fingerprint{Name: name, Transport: TransportQUIC, QUICID: id}
+}
+
+// fingerprintCatalog lists every fingerprint. The Auto names and the QUIC
+// names without a variant are aliases of an entry before them.
+var fingerprintCatalog = []Fingerprint{
+	tcpFingerprint("Golang", utls.HelloGolang),
+	tcpFingerprint("Randomized", utls.HelloRandomized),
+	tcpFingerprint("RandomizedALPN", utls.HelloRandomizedALPN),
+	tcpFingerprint("RandomizedNoALPN", utls.HelloRandomizedNoALPN),
+	tcpFingerprint("Firefox_55", utls.HelloFirefox_55),
+	tcpFingerprint("Firefox_56", utls.HelloFirefox_56),
+	tcpFingerprint("Firefox_63", utls.HelloFirefox_63),
+	tcpFingerprint("Firefox_65", utls.HelloFirefox_65),
+	tcpFingerprint("Firefox_99", utls.HelloFirefox_99),
+	tcpFingerprint("Firefox_102", utls.HelloFirefox_102),
+	tcpFingerprint("Firefox_105", utls.HelloFirefox_105),
+	tcpFingerprint("Firefox_120", utls.HelloFirefox_120),
+	tcpFingerprint("Firefox_Auto", utls.HelloFirefox_Auto),
+	tcpFingerprint("Chrome_58", utls.HelloChrome_58),
+	tcpFingerprint("Chrome_62", utls.HelloChrome_62),
+	tcpFingerprint("Chrome_70", utls.HelloChrome_70),
+	tcpFingerprint("Chrome_72", utls.HelloChrome_72),
+	tcpFingerprint("Chrome_83", utls.HelloChrome_83),
+	tcpFingerprint("Chrome_87", utls.HelloChrome_87),
+	tcpFingerprint("Chrome_96", utls.HelloChrome_96),
+	tcpFingerprint("Chrome_100", utls.HelloChrome_100),
+	tcpFingerprint("Chrome_102", utls.HelloChrome_102),
+	tcpFingerprint("Chrome_106_Shuffle", utls.HelloChrome_106_Shuffle),
+	tcpFingerprint("Chrome_100_PSK", utls.HelloChrome_100_PSK),
+	tcpFingerprint("Chrome_112_PSK_Shuf", utls.HelloChrome_112_PSK_Shuf),
+	tcpFingerprint("Chrome_114_Padding_PSK_Shuf", utls.HelloChrome_114_Padding_PSK_Shuf),
+	tcpFingerprint("Chrome_115_PQ", utls.HelloChrome_115_PQ),
+	tcpFingerprint("Chrome_115_PQ_PSK", utls.HelloChrome_115_PQ_PSK),
+	tcpFingerprint("Chrome_120", utls.HelloChrome_120),
+	tcpFingerprint("Chrome_120_PQ", utls.HelloChrome_120_PQ),
+	tcpFingerprint("Chrome_131", utls.HelloChrome_131),
+	tcpFingerprint("Chrome_Auto", utls.HelloChrome_Auto),
+	tcpFingerprint("IOS_11_1", utls.HelloIOS_11_1),
+	tcpFingerprint("IOS_12_1", utls.HelloIOS_12_1),
+	tcpFingerprint("IOS_13", utls.HelloIOS_13),
+	tcpFingerprint("IOS_14", utls.HelloIOS_14),
+	tcpFingerprint("IOS_Auto", utls.HelloIOS_Auto),
+	tcpFingerprint("Android_11_OkHttp", utls.HelloAndroid_11_OkHttp),
+	tcpFingerprint("Edge_85", utls.HelloEdge_85),
+	tcpFingerprint("Edge_106", utls.HelloEdge_106),
+	tcpFingerprint("Edge_Auto", utls.HelloEdge_Auto),
+	tcpFingerprint("Safari_16_0", utls.HelloSafari_16_0),
+	tcpFingerprint("Safari_Auto", utls.HelloSafari_Auto),
+	tcpFingerprint("360_7_5", utls.Hello360_7_5),
+	tcpFingerprint("360_11_0", utls.Hello360_11_0),
+	tcpFingerprint("360_Auto", utls.Hello360_Auto),
+	tcpFingerprint("QQ_11_1", utls.HelloQQ_11_1),
+	tcpFingerprint("QQ_Auto", utls.HelloQQ_Auto),
+
+	quicFingerprint("Firefox_116A", quic.QUICFirefox_116A),
+	quicFingerprint("Firefox_116B", quic.QUICFirefox_116B),
+	quicFingerprint("Firefox_116C", quic.QUICFirefox_116C),
+	quicFingerprint("Firefox_116", quic.QUICFirefox_116),
+	quicFingerprint("Chrome_115_IPv4", quic.QUICChrome_115_IPv4),
+	quicFingerprint("Chrome_115_IPv6", quic.QUICChrome_115_IPv6),
+	quicFingerprint("Chrome_115", quic.QUICChrome_115),
+}
+
+// Fingerprints returns the catalog of fingerprints, TCP ones first.
+func Fingerprints() []Fingerprint {
+	return append([]Fingerprint(nil), fingerprintCatalog...)
+}
+
+// ParseFingerprint returns the uTLS ClientHelloID of a TCP fingerprint of
+// the catalog, such as "Firefox_Auto" or "Chrome_120". The name is case
+// insensitive.
+func ParseFingerprint(name string) (utls.ClientHelloID, error) {
+	for _, f := range fingerprintCatalog {
+		if f.Transport == TransportTCP && strings.EqualFold(f.Name, name) {
+			return f.ClientHelloID, nil
+		}
+	}
+	return utls.ClientHelloID{}, fmt.Errorf("unknown fingerprint %q", name)
+}
+
+// Spec returns the standard flow of the fingerprint: a TLS 1.3 handshake over
+// TCP, or over QUIC. TCP fingerprints without TLS 1.3 make a handshake with
+// whatever versions they offer.
+func (f Fingerprint) Spec() TestSpec {
+	if f.Transport == TransportQUIC {
+		return TestSpec{
+			Label:      "Fingerprint - QUIC - TLS 1.3 - uQUIC " + f.Name,
+			Transport:  TransportQUIC,
+			Library:    LibraryUQUIC,
+			QUICID:     f.QUICID,
+			MinVersion: tls.VersionTLS13,
+			MaxVersion: tls.VersionTLS13,
+			ALPN:       []string{"h3"},
+		}
+	}
+	if !offersTLS13(f.ClientHelloID) {
+		return TestSpec{
+			Label:         "Fingerprint - TCP - uTLS " + f.Name,
+			Transport:     TransportTCP,
+			Library:       LibraryUTLS,
+			ClientHelloID: f.ClientHelloID,
+		}
+	}
+	return TestSpec{
+		Label:         "Fingerprint - TCP - TLS 1.3 - uTLS " + f.Name,
+		Transport:     TransportTCP,
+		Library:       LibraryUTLS,
+		ClientHelloID: f.ClientHelloID,
+		MinVersion:    tls.VersionTLS13,
+		MaxVersion:    tls.VersionTLS13,
+	}
+}
+
+// offersTLS13 reports whether the fixed ClientHello of a fingerprint offers
+// TLS 1.3. Golang sends the ClientHello of the config, and randomized
+// fingerprints have no fixed one.
+func offersTLS13(id utls.ClientHelloID) bool {
+	switch {
+	case id == utls.HelloGolang:
+		return true
+	case strings.HasPrefix(id.Client, "Randomized"):
+		return false
+	}
+	spec, err := utls.UTLSIdToSpec(id)
+	if err != nil {
+		return false
+	}
+	for _, e := range spec.Extensions {
+		if sv, ok := e.(*utls.SupportedVersionsExtension); ok {
+			return slices.Contains(sv.Versions, tls.VersionTLS13)
+		}
+	}
+	return false
+}
+
+// FingerprintTests returns a test of the standard flow for every fingerprint
+// whose name matches any of the patterns, as in SelectTests. Aliases of a
+// fingerprint already selected are skipped.
+func FingerprintTests(patterns []string) ([]Test, error) {
+	res, err := compileTestPatterns(patterns)
+	if err != nil {
+		return nil, err
+	}
+
+	var tests []Test
+	var tcpIDs []utls.ClientHelloID
+	var quicIDs []quic.QUICID
+	for _, f := range fingerprintCatalog {
+		if !matchesAny(res, f.Name) {
+			continue
+		}
+		switch f.Transport {
+		case TransportTCP:
+			if slices.Contains(tcpIDs, f.ClientHelloID) {
+				continue
+			}
+			tcpIDs = append(tcpIDs, f.ClientHelloID)
+		case TransportQUIC:
+			if slices.Contains(quicIDs, f.QUICID) {
+				continue
+			}
+			quicIDs = append(quicIDs, f.QUICID)
+		}
+		tests = append(tests, NewTest(f.Spec()))
+	}
+
+	if len(tests) == 0 {
+		return nil, fmt.Errorf("no fingerprint matches %s", strings.Join(patterns, ", "))
+	}
+	return tests, nil
+}
@@ -0,0 +1,430 @@
+package probe
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"strings"
+
+	utls "github.com/refraction-networking/utls"
+	"github.com/refraction-networking/utls/dicttls"
+)
+
+// FuzzGenerator is a way of making a ClientHello out of a seed.
+type FuzzGenerator string
+
+const (
+	// FuzzRandomized, FuzzRandomizedALPN and FuzzRandomizedNoALPN are the
+	// uTLS HelloRandomized fingerprints.
+	FuzzRandomized       FuzzGenerator = "randomized"
+	FuzzRandomizedALPN   FuzzGenerator = "randomized-alpn"
+	FuzzRandomizedNoALPN FuzzGenerator = "randomized-noalpn"
+	// FuzzMutate mutates the cipher suites, extensions, groups and padding
+	// of a catalog fingerprint.
+	FuzzMutate FuzzGenerator = "mutate"
+)
+
+// FuzzGenerators lists every generator.
+var FuzzGenerators = []FuzzGenerator{FuzzRandomized, FuzzRandomizedALPN, FuzzRandomizedNoALPN, FuzzMutate}
+
+// FuzzHello is a generated ClientHello. The same generator, base and seed
+// always make the same ClientHello, apart from the random values every
+// handshake has.
+type FuzzHello struct {
+	Generator FuzzGenerator
+	// Base is the catalog fingerprint FuzzMutate starts from.
+	Base string
+	Seed uint64
+}
+
+// String returns the ID of the hello, generator:seed or mutate:base:seed,
+// which ParseFuzzHello reads back.
+func (h FuzzHello) String() string {
+	if h.Generator == FuzzMutate {
+		return fmt.Sprintf("%s:%s:%d", h.Generator, h.Base, h.Seed)
+	}
+	return fmt.Sprintf("%s:%d", h.Generator, h.Seed)
+}
+
+// ParseFuzzHello reads the ID of a FuzzHello.
+func ParseFuzzHello(id string) (FuzzHello, error) {
+	parts := strings.Split(id, ":")
+	h := FuzzHello{Generator: FuzzGenerator(parts[0])}
+	if !slices.Contains(FuzzGenerators, h.Generator) {
+		return FuzzHello{}, fmt.Errorf("invalid fuzz hello %q: unknown generator %q", id, parts[0])
+	}
+	want := 2
+	if h.Generator == FuzzMutate {
+		want = 3
+		h.Base = parts[min(1, len(parts)-1)]
+	}
+	if len(parts) != want {
+		return FuzzHello{}, fmt.Errorf("invalid fuzz hello %q: want generator:seed or mutate:base:seed", id)
+	}
+	seed, err := strconv.ParseUint(parts[len(parts)-1], 10, 64)
+	if err != nil {
+		return FuzzHello{}, fmt.Errorf("invalid fuzz hello %q: bad seed", id)
+	}
+	h.Seed = seed
+	if err := h.check(); err != nil {
+		return FuzzHello{}, fmt.Errorf("invalid fuzz hello %q: %w", id, err)
+	}
+	return h, nil
+}
+
+func (h FuzzHello) check() error {
+	if h.Generator == FuzzMutate {
+		_, err := h.baseSpec()
+		return err
+	}
+	return nil
+}
+
+// baseSpec returns the ClientHello the mutate generator starts from.
+func (h FuzzHello) baseSpec() (utls.ClientHelloSpec, error) {
+	id, err := ParseFingerprint(h.Base)
+	if err != nil {
+		return utls.ClientHelloSpec{}, err
+	}
+	spec, err := utls.UTLSIdToSpec(id)
+	if err != nil {
+		return utls.ClientHelloSpec{}, fmt.Errorf("fingerprint %q has no fixed ClientHello to mutate", h.Base)
+	}
+	return spec, nil
+}
+
+// clientHelloID returns the uTLS fingerprint of a HelloRandomized generator,
+// seeded from the hello's seed.
+func (h FuzzHello) clientHelloID() utls.ClientHelloID {
+	seed := utls.PRNGSeed(sha256.Sum256(binary.BigEndian.AppendUint64(nil, h.Seed)))
+	id := map[FuzzGenerator]utls.ClientHelloID{
+		FuzzRandomized:       utls.HelloRandomized,
+		FuzzRandomizedALPN:   utls.HelloRandomizedALPN,
+		FuzzRandomizedNoALPN: utls.HelloRandomizedNoALPN,
+	}[h.Generator]
+	id.Seed = &seed
+	return id
+}
+
+// Spec returns a TCP test sending the hello.
+func (h FuzzHello) Spec() (TestSpec, error) {
+	if err := h.check(); err != nil {
+		return TestSpec{}, err
+	}
+	spec := TestSpec{
+		Label:     "Fuzz " + h.String() + " - TCP - uTLS",
+		Transport: TransportTCP,
+		Library:   LibraryUTLS,
+	}
+	if h.Generator != FuzzMutate {
+		spec.ClientHelloID = h.clientHelloID()
+		return spec, nil
+	}
+	spec.ClientHelloID = utls.HelloCustom
+	build, err := perAttemptSpec(h.mutate)
+	if err != nil {
+		return TestSpec{}, err
+	}
+	spec.ClientHelloSpec = build
+	return spec, nil
+}
+
+// build applies the hello to a connection that is never used, to see the
+// ClientHello it makes for sni.
+func (h FuzzHello) build(sni string) (*utls.UConn, error) {
+	if err := h.check(); err != nil {
+		return nil, err
+	}
+	config := &utls.Config{ServerName: sni, OmitEmptyPsk: true}
+	var uConn *utls.UConn
+	if h.Generator == FuzzMutate {
+		spec, err := h.mutate()
+		if err != nil {
+			return nil, err
+		}
+		uConn = utls.UClient(nil, config, utls.HelloCustom)
+		if err := uConn.ApplyPreset(spec); err != nil {
+			return nil, err
+		}
+	} else {
+		uConn = utls.UClient(nil, config, h.clientHelloID())
+	}
+	if err := uConn.BuildHandshakeState(); err != nil {
+		return nil, err
+	}
+	return uConn, nil
+}
+
+// ClientHelloSpec returns the spec of the hello, to export it with
+// MarshalHelloSpec.
+func (h FuzzHello) ClientHelloSpec() (*utls.ClientHelloSpec, error) {
+	if h.Generator == FuzzMutate {
+		if err := h.check(); err != nil {
+			return nil, err
+		}
+		return h.mutate()
+	}
+	uConn, err := h.build("example.com")
+	if err != nil {
+		return nil, err
+	}
+	hello := uConn.HandshakeState.Hello
+	spec := &utls.ClientHelloSpec{
+		CipherSuites:       hello.CipherSuites,
+		CompressionMethods: hello.CompressionMethods,
+		Extensions:         uConn.Extensions,
+	}
+	if !slices.ContainsFunc(spec.Extensions, func(e utls.TLSExtension) bool {
+		_, ok := e.(*utls.SupportedVersionsExtension)
+		return ok
+	}) {
+		spec.TLSVersMin, spec.TLSVersMax = utls.VersionTLS10, hello.Vers
+	}
+	return spec, nil
+}
+
+// Features describes what the ClientHello the hello makes for sni is made
+// of: its cipher suites, extensions, groups, key shares, ALPN protocols and
+// size, to compare hellos that get through with those that don't.
+func (h FuzzHello) Features(sni string) ([]string, error) {
+	uConn, err := h.build(sni)
+	if err != nil {
+		return nil, err
+	}
+
+	var features []string
+	for _, c := range uConn.HandshakeState.Hello.CipherSuites {
+		if isGREASE(c) {
+			continue
+		}
+		name, ok := dicttls.DictCipherSuiteValueIndexed[c]
+		if !ok {
+			name = fmt.Sprintf("0x%04x", c)
+		}
+		features = append(features, "cipher "+name)
+	}
+	for _, ext := range uConn.Extensions {
+		m, err := marshalExtension(ext)
+		if err != nil {
+			features = append(features, fmt.Sprintf("extension %T", ext))
+			continue
+		}
+		features = append(features, fmt.Sprint("extension ", m["name"]))
+		switch ext := ext.(type) {
+		case *utls.SupportedCurvesExtension:
+			for _, c := range ext.Curves {
+				features = append(features, "group "+groupName(c))
+			}
+		case *utls.KeyShareExtension:
+			for _, ks := range ext.KeyShares {
+				features = append(features, "key share "+groupName(ks.Group))
+			}
+		case *utls.ALPNExtension:
+			for _, proto := range ext.AlpnProtocols {
+				features = append(features, "ALPN "+proto)
+			}
+		}
+	}
+
+	size := len(uConn.HandshakeState.Hello.Raw)
+	switch {
+	case size < 256:
+		features = append(features, "size under 256 bytes")
+	case size < 512:
+		features = append(features, "size 256-511 bytes")
+	case size < 1024:
+		features = append(features, "size 512-1023 bytes")
+	default:
+		features = append(features, "size 1024 bytes or more")
+	}
+
+	slices.Sort(features)
+	return slices.Compact(features), nil
+}
+
+// optionalExtension reports whether a mutation may drop the extension
+// without breaking the handshake.
+func optionalExtension(ext utls.TLSExtension) bool {
+	switch ext.(type) {
+	case *utls.StatusRequestExtension, *utls.SCTExtension, *utls.SessionTicketExtension,
+		*utls.ExtendedMasterSecretExtension, *utls.RenegotiationInfoExtension,
+		*utls.UtlsCompressCertExtension, *utls.ApplicationSettingsExtension,
+		*utls.GREASEEncryptedClientHelloExtension, *utls.FakeDelegatedCredentialsExtension,
+		*utls.FakeRecordSizeLimitExtension, *utls.SignatureAlgorithmsCertExtension,
+		*utls.SupportedPointsExtension, *utls.ALPNExtension, *utls.UtlsPaddingExtension:
+		return true
+	}
+	return false
+}
+
+// movableExtensions returns the positions of the extensions whose order
+// doesn't matter: all but GREASE, padding and pre_shared_key.
+func movableExtensions(exts []utls.TLSExtension) []int {
+	var movable []int
+	for i, ext := range exts {
+		switch ext.(type) {
+		case *utls.UtlsGREASEExtension, *utls.UtlsPaddingExtension, utls.PreSharedKeyExtension:
+		default:
+			movable = append(movable, i)
+		}
+	}
+	return movable
+}
+
+// keyShareGroups are the groups uTLS can make a key share for.
+var keyShareGroups = []utls.CurveID{
+	utls.X25519MLKEM768, utls.X25519Kyber768Draft00, utls.X25519,
+	utls.CurveP256, utls.CurveP384, utls.CurveP521,
+}
+
+// mutate returns the base fingerprint with every mutation the seed picks.
+func (h FuzzHello) mutate() (*utls.ClientHelloSpec, error) {
+	spec, err := h.baseSpec()
+	if err != nil {
+		return nil, err
+	}
+	r := rand.New(rand.NewPCG(h.Seed, 0))
+
+	// The base fingerprint may come shuffled, so put it in an order of
+	// its own for the same seed to make the same mutations.
+	movable := movableExtensions(spec.Extensions)
+	sorted := make([]utls.TLSExtension, len(movable))
+	for i, pos := range movable {
+		sorted[i] = spec.Extensions[pos]
+	}
+	slices.SortStableFunc(sorted, func(a, b utls.TLSExtension) int {
+		return cmp.Compare(fmt.Sprintf("%T", a), fmt.Sprintf("%T", b))
+	})
+	for i, pos := range movable {
+		spec.Extensions[pos] = sorted[i]
+	}
+
+	// Cipher suites: shuffle them, and drop some while keeping one of
+	// each TLS version offered.
+	var suites, tls13 []uint16
+	for _, c := range spec.CipherSuites {
+		if c == utls.GREASE_PLACEHOLDER {
+			continue
+		}
+		suites = append(suites, c)
+		if c>>8 == 0x13 {
+			tls13 = append(tls13, c)
+		}
+	}
+	if r.IntN(2) == 0 {
+		r.Shuffle(len(suites), func(i, j int) { suites[i], suites[j] = suites[j], suites[i] })
+	}
+	if r.IntN(2) == 0 {
+		kept := suites[:0:0]
+		for _, c := range suites {
+			if r.IntN(3) > 0 {
+				kept = append(kept, c)
+			}
+		}
+		if !slices.ContainsFunc(kept, func(c uint16) bool { return c>>8 == 0x13 }) && len(tls13) > 0 {
+			kept = append([]uint16{tls13[0]}, kept...)
+		}
+		if !slices.ContainsFunc(kept, func(c uint16) bool { return c>>8 != 0x13 }) && len(suites) > len(tls13) {
+			kept = append(kept, suites[slices.IndexFunc(suites, func(c uint16) bool { return c>>8 != 0x13 })])
+		}
+		suites = kept
+	}
+	if slices.Contains(spec.CipherSuites, utls.GREASE_PLACEHOLDER) {
+		suites = append([]uint16{utls.GREASE_PLACEHOLDER}, suites...)
+	}
+	spec.CipherSuites = suites
+
+	// Optional extensions: drop some. ALPS goes with ALPN.
+	var exts []utls.TLSExtension
+	dropALPN := r.IntN(4) == 0
+	for _, ext := range spec.Extensions {
+		switch ext.(type) {
+		case *utls.ALPNExtension, *utls.ApplicationSettingsExtension:
+			if dropALPN {
+				continue
+			}
+		case *utls.UtlsPaddingExtension:
+			// Padding has its own mutation below.
+		default:
+			if optionalExtension(ext) && r.IntN(4) == 0 {
+				continue
+			}
+		}
+		exts = append(exts, ext)
+	}
+
+	// Groups: drop some, and share a key for the first group left if
+	// none of the shared ones is.
+	for _, ext := range exts {
+		curves, ok := ext.(*utls.SupportedCurvesExtension)
+		if !ok || r.IntN(2) == 0 {
+			continue
+		}
+		kept := curves.Curves[:0:0]
+		for _, c := range curves.Curves {
+			if c == utls.GREASE_PLACEHOLDER || r.IntN(3) > 0 {
+				kept = append(kept, c)
+			}
+		}
+		if !slices.ContainsFunc(kept, func(c utls.CurveID) bool { return slices.Contains(keyShareGroups, c) }) {
+			kept = append(kept, utls.X25519)
+		}
+		curves.Curves = kept
+		for _, ext := range exts {
+			if ks, ok := ext.(*utls.KeyShareExtension); ok {
+				ks.KeyShares = slices.DeleteFunc(ks.KeyShares, func(s utls.KeyShare) bool {
+					return s.Group != utls.GREASE_PLACEHOLDER && !slices.Contains(kept, s.Group)
+				})
+				if !slices.ContainsFunc(ks.KeyShares, func(s utls.KeyShare) bool { return s.Group != utls.GREASE_PLACEHOLDER }) {
+					first := kept[slices.IndexFunc(kept, func(c utls.CurveID) bool { return slices.Contains(keyShareGroups, c) })]
+					ks.KeyShares = append(ks.KeyShares, utls.KeyShare{Group: first})
+				}
+			}
+		}
+	}
+
+	// Extension order: shuffled from the seed. GREASE stays in place,
+	// padding and pre_shared_key stay last.
+	movable = movableExtensions(exts)
+	r.Shuffle(len(movable), func(i, j int) {
+		exts[movable[i]], exts[movable[j]] = exts[movable[j]], exts[movable[i]]
+	})
+
+	// Padding: keep the base's, drop it, pad BoringSSL style or pad to a
+	// random length.
+	padding := slices.IndexFunc(exts, func(e utls.TLSExtension) bool {
+		_, ok := e.(*utls.UtlsPaddingExtension)
+		return ok
+	})
+	var pad utls.TLSExtension
+	switch r.IntN(4) {
+	case 0:
+		if padding >= 0 {
+			pad = exts[padding]
+		}
+	case 1:
+	case 2:
+		pad = &utls.UtlsPaddingExtension{GetPaddingLen: utls.BoringPaddingStyle}
+	case 3:
+		pad = &utls.UtlsPaddingExtension{PaddingLen: 1 + r.IntN(512), WillPad: true}
+	}
+	if padding >= 0 {
+		exts = slices.Delete(exts, padding, padding+1)
+	}
+	if pad != nil {
+		last := len(exts)
+		if last > 0 {
+			if _, ok := exts[last-1].(utls.PreSharedKeyExtension); ok {
+				last--
+			}
+		}
+		exts = slices.Insert(exts, last, pad)
+	}
+
+	spec.Extensions = exts
+	return &spec, nil
+}
@@ -0,0 +1,364 @@
+package probe
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+
+	utls "github.com/refraction-networking/utls"
+	"github.com/refraction-networking/utls/dicttls"
+)
+
+// echExtensionName is the GREASE ECH extension Chrome sends, which the JSON
+// format of uTLS has no extension type for.
+const echExtensionName = "encrypted_client_hello"
+
+// extraGroups are the groups uTLS can send whose names its JSON format
+// doesn't know.
+var extraGroups = map[string]utls.CurveID{
+	"X25519MLKEM768":        utls.X25519MLKEM768,
+	"X25519Kyber768Draft00": utls.X25519Kyber768Draft00,
+}
+
+func groupName(id utls.CurveID) string {
+	if id == utls.GREASE_PLACEHOLDER || isGREASE(uint16(id)) {
+		return "GREASE"
+	}
+	for name, extra := range extraGroups {
+		if id == extra {
+			return name
+		}
+	}
+	if name, ok := dicttls.DictSupportedGroupsValueIndexed[uint16(id)]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%04x", uint16(id))
+}
+
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// perAttemptSpec returns a ClientHelloSpec hook that calls build for every
+// attempt, since the extensions of a spec hold the state of a handshake.
+// build is called once first, so that its error comes out when the test is
+// made rather than on every attempt.
+func perAttemptSpec(build func() (*utls.ClientHelloSpec, error)) (func(string) (*utls.ClientHelloSpec, error), error) {
+	if _, err := build(); err != nil {
+		return nil, err
+	}
+	return func(string) (*utls.ClientHelloSpec, error) { return build() }, nil
+}
+
+// helloSpecExtras are the parts of a spec the uTLS unmarshaler can't read,
+// taken out before it runs and put back after.
+type helloSpecExtras struct {
+	// ech holds the positions of GREASE ECH extensions.
+	ech []int
+	// groups and shares hold the extra groups of the supported_groups and
+	// key_share extensions by extension position, in list order.
+	groups map[int][]extraGroup
+	shares map[int][]extraGroup
+}
+
+type extraGroup struct {
+	pos int
+	id  utls.CurveID
+}
+
+// takeExtraGroups removes the extra groups from a list of names or of
+// objects with a group key.
+func takeExtraGroups(list []any, name func(any) string) ([]any, []extraGroup) {
+	var taken []extraGroup
+	kept := list[:0:0]
+	for i, v := range list {
+		if id, ok := extraGroups[name(v)]; ok {
+			taken = append(taken, extraGroup{pos: i, id: id})
+			continue
+		}
+		kept = append(kept, v)
+	}
+	return kept, taken
+}
+
+// extract takes the extras out of a spec decoded as generic JSON.
+func (x *helloSpecExtras) extract(doc map[string]any) {
+	exts, _ := doc["extensions"].([]any)
+	var kept []any
+	for i, e := range exts {
+		ext, _ := e.(map[string]any)
+		switch ext["name"] {
+		case echExtensionName:
+			x.ech = append(x.ech, i)
+			continue
+		case "supported_groups":
+			if list, ok := ext["named_group_list"].([]any); ok {
+				ext["named_group_list"], x.groups[len(kept)] = takeExtraGroups(list, func(v any) string {
+					s, _ := v.(string)
+					return s
+				})
+			}
+		case "key_share":
+			if list, ok := ext["client_shares"].([]any); ok {
+				ext["client_shares"], x.shares[len(kept)] = takeExtraGroups(list, func(v any) string {
+					share, _ := v.(map[string]any)
+					s, _ := share["group"].(string)
+					return s
+				})
+			}
+		}
+		kept = append(kept, e)
+	}
+	if exts != nil {
+		doc["extensions"] = kept
+	}
+}
+
+// restore puts the extras back into the spec uTLS unmarshaled.
+func (x *helloSpecExtras) restore(spec *utls.ClientHelloSpec) {
+	for i, ext := range spec.Extensions {
+		switch ext := ext.(type) {
+		case *utls.SupportedCurvesExtension:
+			for _, g := range x.groups[i] {
+				ext.Curves = slices.Insert(ext.Curves, min(g.pos, len(ext.Curves)), g.id)
+			}
+		case *utls.KeyShareExtension:
+			for _, g := range x.shares[i] {
+				ext.KeyShares = slices.Insert(ext.KeyShares, min(g.pos, len(ext.KeyShares)), utls.KeyShare{Group: g.id})
+			}
+		}
+	}
+	for _, pos := range x.ech {
+		spec.Extensions = slices.Insert(spec.Extensions, min(pos, len(spec.Extensions)), utls.TLSExtension(utls.BoringGREASEECH()))
+	}
+}
+
+func unmarshalHelloSpec(data []byte) (*utls.ClientHelloSpec, error) {
+	var doc map[string]any
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	extras := helloSpecExtras{groups: make(map[int][]extraGroup), shares: make(map[int][]extraGroup)}
+	extras.extract(doc)
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	var u utls.ClientHelloSpecJSONUnmarshaler
+	if err := json.Unmarshal(data, &u); err != nil {
+		return nil, err
+	}
+	if u.CipherSuites == nil || u.Extensions == nil {
+		return nil, fmt.Errorf("cipher_suites and extensions are required")
+	}
+	if u.CompressionMethods == nil {
+		u.CompressionMethods = &utls.CompressionMethodsJSONUnmarshaler{}
+		if err := u.CompressionMethods.UnmarshalJSON([]byte(`["NULL"]`)); err != nil {
+			return nil, err
+		}
+	}
+	spec := u.ClientHelloSpec()
+	extras.restore(&spec)
+	return &spec, nil
+}
+
+// ParseHelloSpec returns a TCP test sending the ClientHello described by
+// data with utls.HelloCustom. data is in the JSON format of
+// utls.ClientHelloSpecJSONUnmarshaler: cipher suites, compression methods
+// and extensions with their parameters by name, "GREASE" placeholders, and
+// the optional min_vers and max_vers. On top of it the format takes the
+// X25519MLKEM768 and X25519Kyber768Draft00 groups and a GREASE
+// encrypted_client_hello extension.
+func ParseHelloSpec(label string, data []byte) (TestSpec, error) {
+	data = append([]byte(nil), data...)
+	build, err := perAttemptSpec(func() (*utls.ClientHelloSpec, error) { return unmarshalHelloSpec(data) })
+	if err != nil {
+		return TestSpec{}, fmt.Errorf("invalid ClientHello spec: %w", err)
+	}
+	return TestSpec{
+		Label:           label,
+		Transport:       TransportTCP,
+		Library:         LibraryUTLS,
+		ClientHelloID:   utls.HelloCustom,
+		ClientHelloSpec: build,
+	}, nil
+}
+
+// helloSpecJSON is a spec in the format of ParseHelloSpec.
+type helloSpecJSON struct {
+	Name               string           `json:"name,omitempty"`
+	CipherSuites       []string         `json:"cipher_suites"`
+	CompressionMethods []string         `json:"compression_methods"`
+	Extensions         []map[string]any `json:"extensions"`
+	MinVers            uint16           `json:"min_vers,omitempty"`
+	MaxVers            uint16           `json:"max_vers,omitempty"`
+}
+
+func namesOf[T ~uint8 | ~uint16](values []T, dict map[T]string, what string) ([]string, error) {
+	names := make([]string, len(values))
+	for i, v := range values {
+		name, ok := dict[v]
+		if !ok {
+			return nil, fmt.Errorf("%s 0x%x has no name", what, uint16(v))
+		}
+		names[i] = name
+	}
+	return names, nil
+}
+
+func signatureSchemeNames(schemes []utls.SignatureScheme) ([]string, error) {
+	values := make([]uint16, len(schemes))
+	for i, s := range schemes {
+		values[i] = uint16(s)
+	}
+	return namesOf(values, dicttls.DictSignatureSchemeValueIndexed, "signature scheme")
+}
+
+var versionNames = map[uint16]string{
+	utls.VersionTLS13: "TLS 1.3",
+	utls.VersionTLS12: "TLS 1.2",
+	utls.VersionTLS11: "TLS 1.1",
+	utls.VersionTLS10: "TLS 1.0",
+}
+
+// marshalExtension returns an extension in the format of ParseHelloSpec,
+// its name and its parameters.
+func marshalExtension(ext utls.TLSExtension) (map[string]any, error) {
+	var err error
+	m := make(map[string]any)
+	switch ext := ext.(type) {
+	case *utls.UtlsGREASEExtension:
+		m["name"] = "GREASE"
+	case *utls.SNIExtension:
+		m["name"] = "server_name"
+	case *utls.StatusRequestExtension:
+		m["name"] = "status_request"
+	case *utls.SupportedCurvesExtension:
+		m["name"] = "supported_groups"
+		groups := make([]string, len(ext.Curves))
+		for i, c := range ext.Curves {
+			groups[i] = groupName(c)
+		}
+		m["named_group_list"] = groups
+	case *utls.SupportedPointsExtension:
+		m["name"] = "ec_point_formats"
+		m["ec_point_format_list"], err = namesOf(ext.SupportedPoints, dicttls.DictECPointFormatValueIndexed, "point format")
+	case *utls.SignatureAlgorithmsExtension:
+		m["name"] = "signature_algorithms"
+		m["supported_signature_algorithms"], err = signatureSchemeNames(ext.SupportedSignatureAlgorithms)
+	case *utls.SignatureAlgorithmsCertExtension:
+		m["name"] = "signature_algorithms_cert"
+		m["supported_signature_algorithms"], err = signatureSchemeNames(ext.SupportedSignatureAlgorithms)
+	case *utls.FakeDelegatedCredentialsExtension:
+		m["name"] = "delegated_credentials"
+		m["supported_signature_algorithms"], err = signatureSchemeNames(ext.SupportedSignatureAlgorithms)
+	case *utls.ALPNExtension:
+		m["name"] = "application_layer_protocol_negotiation"
+		m["protocol_name_list"] = ext.AlpnProtocols
+	case *utls.ApplicationSettingsExtension:
+		m["name"] = "application_settings"
+		m["supported_protocols"] = ext.SupportedProtocols
+	case *utls.SCTExtension:
+		m["name"] = "signed_certificate_timestamp"
+	case *utls.ExtendedMasterSecretExtension:
+		m["name"] = "extended_master_secret"
+	case *utls.SessionTicketExtension:
+		m["name"] = "session_ticket"
+	case *utls.RenegotiationInfoExtension:
+		m["name"] = "renegotiation_info"
+	case *utls.NPNExtension:
+		m["name"] = "next_protocol_negotiation"
+	case *utls.FakeChannelIDExtension:
+		m["name"] = "channel_id"
+		if ext.OldExtensionID {
+			m["name"] = "channel_id_old"
+		}
+	case *utls.FakeRecordSizeLimitExtension:
+		m["name"] = "record_size_limit"
+		m["record_size_limit"] = ext.Limit
+	case *utls.UtlsPaddingExtension:
+		m["name"] = "padding"
+		// A length of 0 pads BoringSSL style.
+		m["len"] = 0
+		if ext.GetPaddingLen == nil && ext.WillPad {
+			m["len"] = ext.PaddingLen
+		}
+	case *utls.UtlsCompressCertExtension:
+		algs := make([]uint16, len(ext.Algorithms))
+		for i, a := range ext.Algorithms {
+			algs[i] = uint16(a)
+		}
+		m["name"] = "compress_certificate"
+		m["algorithms"], err = namesOf(algs, dicttls.DictCertificateCompressionAlgorithmValueIndexed, "certificate compression algorithm")
+	case *utls.KeyShareExtension:
+		shares := make([]map[string]any, len(ext.KeyShares))
+		for i, ks := range ext.KeyShares {
+			shares[i] = map[string]any{"group": groupName(ks.Group)}
+			if groupName(ks.Group) == "GREASE" && len(ks.Data) > 0 {
+				shares[i]["key_exchange"] = ks.Data
+			}
+		}
+		m["name"] = "key_share"
+		m["client_shares"] = shares
+	case *utls.PSKKeyExchangeModesExtension:
+		m["name"] = "psk_key_exchange_modes"
+		m["ke_modes"], err = namesOf(ext.Modes, dicttls.DictPSKKeyExchangeModeValueIndexed, "PSK key exchange mode")
+	case *utls.SupportedVersionsExtension:
+		versions := make([]string, len(ext.Versions))
+		for i, v := range ext.Versions {
+			name, ok := versionNames[v]
+			switch {
+			case v == utls.GREASE_PLACEHOLDER || isGREASE(v):
+				name = "GREASE"
+			case !ok:
+				return nil, fmt.Errorf("version 0x%04x has no name", v)
+			}
+			versions[i] = name
+		}
+		m["name"] = "supported_versions"
+		m["versions"] = versions
+	case *utls.GREASEEncryptedClientHelloExtension:
+		m["name"] = echExtensionName
+	default:
+		return nil, fmt.Errorf("%T can't be written as a spec", ext)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// MarshalHelloSpec writes spec in the format of ParseHelloSpec, under name.
+// Key shares are left for the handshake to make, and GREASE values become
+// placeholders. A pre_shared_key extension is dropped, as without a session
+// to resume it is never sent.
+func MarshalHelloSpec(name string, spec *utls.ClientHelloSpec) ([]byte, error) {
+	out := helloSpecJSON{Name: name, MinVers: spec.TLSVersMin, MaxVers: spec.TLSVersMax}
+	for _, c := range spec.CipherSuites {
+		if c == utls.GREASE_PLACEHOLDER || isGREASE(c) {
+			out.CipherSuites = append(out.CipherSuites, "GREASE")
+			continue
+		}
+		name, ok := dicttls.DictCipherSuiteValueIndexed[c]
+		if !ok {
+			return nil, fmt.Errorf("cipher suite 0x%04x has no name", c)
+		}
+		out.CipherSuites = append(out.CipherSuites, name)
+	}
+	var err error
+	if out.CompressionMethods, err = namesOf(spec.CompressionMethods, dicttls.DictCompMethValueIndexed, "compression method"); err != nil {
+		return nil, err
+	}
+	for _, ext := range spec.Extensions {
+		if _, ok := ext.(utls.PreSharedKeyExtension); ok {
+			continue
+		}
+		m, err := marshalExtension(ext)
+		if err != nil {
+			return nil, err
+		}
+		out.Extensions = append(out.Extensions, m)
+	}
+	return json.MarshalIndent(out, "", "  ")
+}
@@ -0,0 +1,194 @@
+package probe
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/markpash/heybabe/bepass/sni"
+)
+
+// HelloFingerprint identifies the ClientHello an attempt put on the wire.
+type HelloFingerprint struct {
+	// JA3 is the JA3 string of the ClientHello, and JA3Hash its MD5.
+	JA3     string `json:"ja3"`
+	JA3Hash string `json:"ja3_hash"`
+	JA4     string `json:"ja4"`
+	// Extensions are the extension types in the order they were sent,
+	// GREASE included, dash separated like in JA3.
+	Extensions string `json:"extensions"`
+}
+
+const (
+	extServerName uint16 = 0
+	extALPN       uint16 = 16
+)
+
+// extensionTypes returns the types of the extensions of a ClientHello, in
+// the order they were sent.
+func extensionTypes(msg *sni.ClientHelloMsg) []uint16 {
+	types := make([]uint16, len(msg.Extensions))
+	for i, e := range msg.Extensions {
+		types[i] = e.Type
+	}
+	return types
+}
+
+func withoutGREASE(values []uint16) []uint16 {
+	return slices.DeleteFunc(slices.Clone(values), sni.IsGREASE)
+}
+
+func joinValues[T uint8 | uint16](values []T, format func(T) string, sep string) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = format(v)
+	}
+	return strings.Join(parts, sep)
+}
+
+func decimal[T uint8 | uint16](v T) string { return strconv.Itoa(int(v)) }
+
+func hex4(v uint16) string { return fmt.Sprintf("%04x", v) }
+
+// ja3 returns the JA3 string: version, cipher suites, extensions, groups
+// and point formats, without GREASE.
+func ja3(msg *sni.ClientHelloMsg) string {
+	return strings.Join([]string{
+		decimal(msg.Versions),
+		joinValues(withoutGREASE(msg.CipherSuites), decimal, "-"),
+		joinValues(withoutGREASE(extensionTypes(msg)), decimal, "-"),
+		joinValues(withoutGREASE(msg.SupportedCurves), decimal, "-"),
+		joinValues(msg.SupportedPoints, decimal, "-"),
+	}, ",")
+}
+
+var ja4Versions = map[uint16]string{
+	0x0304: "13",
+	0x0303: "12",
+	0x0302: "11",
+	0x0301: "10",
+	0x0300: "s3",
+	0x0002: "s2",
+	0xfeff: "d1",
+	0xfefd: "d2",
+	0xfefc: "d3",
+}
+
+func isAlphanumeric(b byte) bool {
+	return '0' <= b && b <= '9' || 'A' <= b && b <= 'Z' || 'a' <= b && b <= 'z'
+}
+
+// ja4Hash is the truncated SHA-256 JA4 uses for its lists.
+func ja4Hash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:6])
+}
+
+// ja4 returns the JA4 fingerprint of the ClientHello, as sent over TCP or
+// QUIC.
+func ja4(msg *sni.ClientHelloMsg, transport Transport) string {
+	var a strings.Builder
+	if transport == TransportQUIC {
+		a.WriteByte('q')
+	} else {
+		a.WriteByte('t')
+	}
+
+	version := msg.Versions
+	if versions := withoutGREASE(msg.SupportedVersions); len(versions) > 0 {
+		version = slices.Max(versions)
+	}
+	if v, ok := ja4Versions[version]; ok {
+		a.WriteString(v)
+	} else {
+		a.WriteString("00")
+	}
+
+	extensions := withoutGREASE(extensionTypes(msg))
+	if slices.Contains(extensions, extServerName) {
+		a.WriteByte('d')
+	} else {
+		a.WriteByte('i')
+	}
+	ciphers := withoutGREASE(msg.CipherSuites)
+	fmt.Fprintf(&a, "%02d%02d", min(len(ciphers), 99), min(len(extensions), 99))
+
+	var alpn string
+	if len(msg.ALPNProtocols) > 0 {
+		alpn = msg.ALPNProtocols[0]
+	}
+	switch {
+	case alpn == "":
+		a.WriteString("00")
+	case isAlphanumeric(alpn[0]) && isAlphanumeric(alpn[len(alpn)-1]):
+		a.WriteByte(alpn[0])
+		a.WriteByte(alpn[len(alpn)-1])
+	default:
+		h := hex.EncodeToString([]byte(alpn))
+		a.WriteByte(h[0])
+		a.WriteByte(h[len(h)-1])
+	}
+
+	slices.Sort(ciphers)
+	extensions = slices.DeleteFunc(extensions, func(e uint16) bool { return e == extServerName || e == extALPN })
+	slices.Sort(extensions)
+	c := joinValues(extensions, hex4, ",")
+	if sigAlgs := withoutGREASE(msg.SupportedSignatureAlgorithms); len(sigAlgs) > 0 {
+		c += "_" + joinValues(sigAlgs, hex4, ",")
+	}
+
+	return a.String() + "_" + ja4Hash(joinValues(ciphers, hex4, ",")) + "_" + ja4Hash(c)
+}
+
+// FingerprintHello returns the JA3 and JA4 fingerprints of a ClientHello
+// handshake message sent over transport.
+func FingerprintHello(transport Transport, msg []byte) (*HelloFingerprint, error) {
+	hello, err := sni.UnmarshalClientHello(msg)
+	if err != nil {
+		return nil, err
+	}
+	s := ja3(hello)
+	sum := md5.Sum([]byte(s))
+	return &HelloFingerprint{
+		JA3:        s,
+		JA3Hash:    hex.EncodeToString(sum[:]),
+		JA4:        ja4(hello, transport),
+		Extensions: joinValues(extensionTypes(hello), decimal, "-"),
+	}, nil
+}
+
+// helloRecorder keeps the first write on a TCP connection, which is the
+// ClientHello of the TLS handshake made over it.
+type helloRecorder struct {
+	net.Conn
+	first []byte
+}
+
+func (c *helloRecorder) Write(b []byte) (int, error) {
+	if c.first == nil {
+		c.first = slices.Clone(b)
+	}
+	return c.Conn.Write(b)
+}
+
+// fingerprint returns the fingerprint of the recorded ClientHello.
+func (c *helloRecorder) fingerprint() (*HelloFingerprint, error) {
+	if c.first == nil {
+		return nil, errors.New("no ClientHello was sent")
+	}
+	msg, err := sni.ReadClientHello(bytes.NewReader(c.first))
+	if err != nil {
+		return nil, fmt.Errorf("no ClientHello in the first write: %w", err)
+	}
+	return FingerprintHello(TransportTCP, msg.Raw)
+}
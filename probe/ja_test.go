@@ -0,0 +1,120 @@
+package probe
+
+import (
+	"testing"
+
+	utls "github.com/refraction-networking/utls"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// testClientHello builds a ClientHello with GREASE values in its cipher
+// suites, extensions and groups.
+func testClientHello() []byte {
+	extension := func(b *cryptobyte.Builder, typ uint16, body func(b *cryptobyte.Builder)) {
+		b.AddUint16(typ)
+		b.AddUint16LengthPrefixed(body)
+	}
+	var b cryptobyte.Builder
+	b.AddUint8(1)
+	b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint16(0x0303)
+		b.AddBytes(make([]byte, 32))
+		b.AddUint8(0)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddUint16(0x0a0a)
+			b.AddUint16(0x1301)
+			b.AddUint16(0xc02b)
+		})
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) { b.AddUint8(0) })
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			extension(b, 0x1a1a, func(b *cryptobyte.Builder) {})
+			extension(b, 0, func(b *cryptobyte.Builder) {
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddUint8(0)
+					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes([]byte("example.com")) })
+				})
+			})
+			extension(b, 10, func(b *cryptobyte.Builder) {
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddUint16(0x2a2a)
+					b.AddUint16(29)
+					b.AddUint16(23)
+				})
+			})
+			extension(b, 11, func(b *cryptobyte.Builder) {
+				b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) { b.AddUint8(0) })
+			})
+			extension(b, 13, func(b *cryptobyte.Builder) {
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddUint16(0x0403)
+					b.AddUint16(0x0804)
+				})
+			})
+			extension(b, 16, func(b *cryptobyte.Builder) {
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes([]byte("h2")) })
+				})
+			})
+			extension(b, 43, func(b *cryptobyte.Builder) {
+				b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddUint16(0x0304)
+					b.AddUint16(0x0303)
+				})
+			})
+		})
+	})
+	return b.BytesOrPanic()
+}
+
+func TestFingerprintHello(t *testing.T) {
+	f, err := FingerprintHello(TransportTCP, testClientHello())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := HelloFingerprint{
+		JA3:        "771,4865-49195,0-10-11-13-16-43,29-23,0",
+		JA3Hash:    "87991a9b84cb5b4bc5f84c5ecad46032",
+		JA4:        "t13d0206h2_777cda164f4b_fb71836bce29",
+		Extensions: "6682-0-10-11-13-16-43",
+	}
+	if *f != want {
+		t.Errorf("got %+v, want %+v", *f, want)
+	}
+
+	f, err = FingerprintHello(TransportQUIC, testClientHello())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "q13d0206h2_777cda164f4b_fb71836bce29"; f.JA4 != want {
+		t.Errorf("JA4 over QUIC = %q, want %q", f.JA4, want)
+	}
+}
+
+func TestFingerprintHelloChrome(t *testing.T) {
+	// Chrome shuffles its extensions and picks new GREASE values for every
+	// ClientHello, which JA4 doesn't see.
+	for range 10 {
+		uConn := utls.UClient(nil, &utls.Config{ServerName: "example.com"}, utls.HelloChrome_120)
+		if err := uConn.BuildHandshakeState(); err != nil {
+			t.Fatal(err)
+		}
+		f, err := FingerprintHello(TransportTCP, uConn.HandshakeState.Hello.Raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "t13d1516h2_8daaf6152771_02713d6af862"; f.JA4 != want {
+			t.Fatalf("JA4 = %q, want %q", f.JA4, want)
+		}
+	}
+}
+
+func TestJA4Hash(t *testing.T) {
+	if got := ja4Hash(""); got != "000000000000" {
+		t.Errorf("ja4Hash of nothing = %q", got)
+	}
+	// The cipher suites of the JA4 example.
+	ciphers := "002f,0035,009c,009d,1301,1302,1303,c013,c014,c02b,c02c,c02f,c030,cca8,cca9"
+	if got, want := ja4Hash(ciphers), "8daaf6152771"; got != want {
+		t.Errorf("ja4Hash = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,85 @@
+package probe
+
+import (
+	"crypto/tls"
+
+	quic "github.com/refraction-networking/uquic"
+	utls "github.com/refraction-networking/utls"
+)
+
+// testMatrix holds all tests in the exact order we want to execute and display.
+var testMatrix = []TestSpec{
+	{
+		Label:      "Default - TCP - TLS 1.2",
+		Transport:  TransportTCP,
+		Library:    LibraryCryptoTLS,
+		MinVersion: tls.VersionTLS12,
+		MaxVersion: tls.VersionTLS12,
+	},
+	{
+		Label:      "Default - TCP - TLS 1.3",
+		Transport:  TransportTCP,
+		Library:    LibraryCryptoTLS,
+		MinVersion: tls.VersionTLS13,
+		MaxVersion: tls.VersionTLS13,
+	},
+	{
+		Label:      "ECH - TCP - TLS 1.3",
+		Transport:  TransportTCP,
+		Library:    LibraryCryptoTLS,
+		MinVersion: tls.VersionTLS13,
+		MaxVersion: tls.VersionTLS13,
+		ECH:        true,
+	},
+	{
+		Label:         "ECH - TCP - TLS 1.3 - uTLS ChromeAuto",
+		Transport:     TransportTCP,
+		Library:       LibraryUTLS,
+		ClientHelloID: utls.HelloChrome_Auto,
+		MinVersion:    tls.VersionTLS13,
+		MaxVersion:    tls.VersionTLS13,
+		ECH:           true,
+	},
+	{
+		Label:         "Default - TCP - TLS 1.3 - uTLS ChromeAuto",
+		Transport:     TransportTCP,
+		Library:       LibraryUTLS,
+		ClientHelloID: utls.HelloChrome_Auto,
+		MinVersion:    tls.VersionTLS13,
+		MaxVersion:    tls.VersionTLS13,
+	},
+	{
+		Label:      "Default - QUIC - TLS 1.3 - uQUIC Chrome",
+		Transport:  TransportQUIC,
+		Library:    LibraryUQUIC,
+		QUICID:     quic.QUICChrome_115,
+		MinVersion: tls.VersionTLS13,
+		MaxVersion: tls.VersionTLS13,
+		ALPN:       []string{"h3"},
+	},
+	{
+		Label:         "Bepass Fragment - TCP - TLS 1.3 - uTLS ChromeAuto",
+		Transport:     TransportTCP,
+		Library:       LibraryUTLS,
+		ClientHelloID: utls.HelloChrome_Auto,
+		MinVersion:    tls.VersionTLS13,
+		MaxVersion:    tls.VersionTLS13,
+		Fragment: &FragmentOptions{
+			BeforeSNI: [2]int{2000, 2000},
+			SNI:       [2]int{1, 2},
+			AfterSNI:  [2]int{1, 2},
+			Delay:     [2]int{10, 20},
+		},
+	},
+	{
+		// warp-plus settings from warp-plus v1.2.1
+		// NOTE: the version of uTLS used in warp-plus is much older than here.
+		Label:           "WarpPlus Custom - TCP - TLS 1.2",
+		Transport:       TransportTCP,
+		Library:         LibraryUTLS,
+		ClientHelloID:   utls.HelloCustom,
+		ClientHelloSpec: warpPlusClientHelloSpec,
+		MinVersion:      tls.VersionTLS10,
+		MaxVersion:      tls.VersionTLS12,
+	},
+}
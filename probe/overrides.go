@@ -0,0 +1,68 @@
+package probe
+
+import (
+	"crypto/tls"
+	"fmt"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// Override changes the ClientHello of the tests it matches, to adapt the
+// suite to a network without adding tests.
+type Override struct {
+	// Tests is a pattern of the labels to change, as in SelectTests.
+	Tests string
+	// ClientHelloID switches the tests to uTLS with this fingerprint.
+	ClientHelloID *utls.ClientHelloID
+	// Fragment replaces how the tests fragment the ClientHello.
+	Fragment *FragmentOptions
+}
+
+func (o Override) apply(spec TestSpec) (TestSpec, error) {
+	if spec.Transport != TransportTCP {
+		return spec, fmt.Errorf("test %s: only TCP tests can be overridden", spec.Label)
+	}
+	if o.ClientHelloID != nil {
+		// A fingerprint offers the versions of the browser it copies, so
+		// the test would no longer be what its label says.
+		if spec.MaxVersion != 0 && spec.MaxVersion < tls.VersionTLS13 {
+			return spec, fmt.Errorf("test %s: only offers up to %s, which a fingerprint can't keep to", spec.Label, tls.VersionName(spec.MaxVersion))
+		}
+		spec.Library = LibraryUTLS
+		spec.ClientHelloID = *o.ClientHelloID
+		spec.ClientHelloSpec = nil
+	}
+	if o.Fragment != nil {
+		fragment := *o.Fragment
+		spec.Fragment = &fragment
+	}
+	return spec, nil
+}
+
+// ApplyOverrides returns the tests with the overrides applied in order, so a
+// later override wins over an earlier one. Tests without a Spec, such as
+// custom registered ones, can't be overridden.
+func ApplyOverrides(tests []Test, overrides []Override) ([]Test, error) {
+	res := make([]Test, len(tests))
+	copy(res, tests)
+	for _, o := range overrides {
+		re, err := compileTestPattern(o.Tests)
+		if err != nil {
+			return nil, err
+		}
+		for i, tc := range res {
+			if !re.MatchString(tc.Label) {
+				continue
+			}
+			if tc.Spec.Label == "" {
+				return nil, fmt.Errorf("test %s: custom tests can't be overridden", tc.Label)
+			}
+			spec, err := o.apply(tc.Spec)
+			if err != nil {
+				return nil, err
+			}
+			res[i] = NewTest(spec)
+		}
+	}
+	return res, nil
+}
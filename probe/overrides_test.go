@@ -0,0 +1,43 @@
+package probe
+
+import (
+	"testing"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+func TestApplyOverridesFingerprint(t *testing.T) {
+	firefox := utls.HelloFirefox_Auto
+	for _, tc := range []struct {
+		tests   string
+		wantErr bool
+	}{
+		{"Default - TCP - TLS 1.3", false},
+		{"Bepass Fragment*", false},
+		{"Default - TCP - TLS 1.2", true},
+		{"WarpPlus Custom*", true},
+		{"*TCP*", true},
+	} {
+		t.Run(tc.tests, func(t *testing.T) {
+			tests, err := ApplyOverrides(Suite(), []Override{{Tests: tc.tests, ClientHelloID: &firefox}})
+			if tc.wantErr {
+				if err == nil {
+					t.Error("a TLS 1.2 test was moved to a fingerprint")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			re, err := compileTestPattern(tc.tests)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, test := range tests {
+				if re.MatchString(test.Label) && (test.Spec.Library != LibraryUTLS || test.Spec.ClientHelloID != firefox) {
+					t.Errorf("%s: got %s %s, want the Firefox fingerprint", test.Label, test.Spec.Library, test.Spec.Fingerprint())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package probe
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"slices"
+	"time"
+)
+
+// NamedResolver is a resolver along with the name it is displayed as.
+type NamedResolver struct {
+	Name     string
+	Resolver *net.Resolver
+}
+
+// bogonPrefixes are ranges that should never show up in a public DNS answer,
+// on top of what netip already classifies (private, loopback, link-local,
+// multicast and unspecified).
+var bogonPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.0.2.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("198.51.100.0/24"),
+	netip.MustParsePrefix("203.0.113.0/24"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("100::/64"),
+	netip.MustParsePrefix("2001:db8::/32"),
+}
+
+// knownInjectedAddrs are addresses that national filtering systems are known
+// to answer with for blocked names.
+var knownInjectedAddrs = map[netip.Addr]string{
+	netip.MustParseAddr("10.10.34.34"):   "Iran",
+	netip.MustParseAddr("10.10.34.35"):   "Iran",
+	netip.MustParseAddr("10.10.34.36"):   "Iran",
+	netip.MustParseAddr("195.175.254.2"): "Turkey",
+}
+
+// suspiciousReason returns why an address in a DNS answer looks forged, or
+// the empty string if it looks like a normal public address.
+func suspiciousReason(addr netip.Addr) string {
+	if country, ok := knownInjectedAddrs[addr]; ok {
+		return "known injected address (" + country + ")"
+	}
+	switch {
+	case addr.IsUnspecified():
+		return "unspecified address"
+	case addr.IsLoopback():
+		return "loopback address"
+	case addr.IsPrivate():
+		return "private address"
+	case addr.IsLinkLocalUnicast():
+		return "link-local address"
+	case addr.IsMulticast():
+		return "multicast address"
+	}
+	for _, p := range bogonPrefixes {
+		if p.Contains(addr) {
+			return "bogon address (" + p.String() + ")"
+		}
+	}
+	return ""
+}
+
+// DNSAnswer is what a single resolver returned for the SNI.
+type DNSAnswer struct {
+	Resolver string
+	V4       []netip.Addr
+	V6       []netip.Addr
+	Duration time.Duration
+	Err      error
+}
+
+func (a DNSAnswer) Addrs() []netip.Addr {
+	return append(slices.Clone(a.V4), a.V6...)
+}
+
+// PoisonCheck is the comparison of the primary resolver's answer against
+// the answers of the trusted (encrypted) resolvers.
+type PoisonCheck struct {
+	Primary DNSAnswer
+	Trusted []DNSAnswer
+	// Suspicious maps addresses of the primary answer to why they look forged.
+	Suspicious map[netip.Addr]string
+	// Verdict is one of "consistent", "differs", "inconclusive",
+	// "blocked" or "poisoned".
+	Verdict string
+}
+
+// checkPoisoning resolves the SNI through the primary resolver and every
+// trusted resolver and compares the answers.
+func checkPoisoning(ctx context.Context, sni string, getv4, getv6 bool, primary NamedResolver, trusted []NamedResolver) PoisonCheck {
+	lookup := func(r NamedResolver) DNSAnswer {
+		t0 := time.Now()
+		v4, v6, err := resolve(ctx, r.Resolver, sni, getv4, getv6)
+		return DNSAnswer{Resolver: r.Name, V4: v4, V6: v6, Duration: time.Since(t0), Err: err}
+	}
+
+	pc := PoisonCheck{
+		Primary:    lookup(primary),
+		Suspicious: make(map[netip.Addr]string),
+	}
+
+	var trustedAddrs []netip.Addr
+	for _, r := range trusted {
+		answer := lookup(r)
+		pc.Trusted = append(pc.Trusted, answer)
+		trustedAddrs = append(trustedAddrs, answer.Addrs()...)
+	}
+
+	for _, addr := range pc.Primary.Addrs() {
+		if reason := suspiciousReason(addr); reason != "" {
+			pc.Suspicious[addr] = reason
+		}
+	}
+
+	switch {
+	case len(trustedAddrs) == 0:
+		// Nothing to compare against, as when the encrypted resolvers are
+		// blocked too. Only the primary answer itself can give it away.
+		pc.Verdict = "inconclusive"
+		if len(pc.Suspicious) > 0 {
+			pc.Verdict = "poisoned"
+		}
+	case pc.Primary.Err != nil:
+		// The name exists, yet the resolver says it doesn't. Any other
+		// failure, a timeout or SERVFAIL, may just be the resolver.
+		var dnsErr *net.DNSError
+		if errors.As(pc.Primary.Err, &dnsErr) && dnsErr.IsNotFound {
+			pc.Verdict = "blocked"
+		} else {
+			pc.Verdict = "inconclusive"
+		}
+	case slices.ContainsFunc(pc.Primary.Addrs(), func(a netip.Addr) bool {
+		// A suspicious address the trusted resolvers agree on is odd, but
+		// it is not something that was injected along the way.
+		_, suspicious := pc.Suspicious[a]
+		return suspicious && !slices.Contains(trustedAddrs, a)
+	}):
+		pc.Verdict = "poisoned"
+	case slices.ContainsFunc(pc.Primary.Addrs(), func(a netip.Addr) bool { return slices.Contains(trustedAddrs, a) }):
+		pc.Verdict = "consistent"
+	default:
+		// No overlap at all. CDNs hand out different addresses to different
+		// resolvers, so this alone doesn't prove anything.
+		pc.Verdict = "differs"
+	}
+
+	return pc
+}
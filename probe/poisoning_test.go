@@ -0,0 +1,84 @@
+package probe
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"os"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeResolver answers every A query with addrs, or with rcode when it isn't
+// a success. A nil addrs with a success rcode times out.
+func fakeResolver(name string, rcode dnsmessage.RCode, addrs ...string) NamedResolver {
+	exchange := func(ctx context.Context, msg []byte) ([]byte, error) {
+		if rcode == dnsmessage.RCodeSuccess && addrs == nil {
+			return nil, os.ErrDeadlineExceeded
+		}
+		var query dnsmessage.Message
+		if err := query.Unpack(msg); err != nil {
+			return nil, err
+		}
+		b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: query.ID, Response: true, RCode: rcode})
+		b.StartQuestions()
+		for _, q := range query.Questions {
+			b.Question(q)
+		}
+		b.StartAnswers()
+		for _, q := range query.Questions {
+			if q.Type != dnsmessage.TypeA || rcode != dnsmessage.RCodeSuccess {
+				continue
+			}
+			for _, addr := range addrs {
+				h := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60}
+				b.AResource(h, dnsmessage.AResource{A: netip.MustParseAddr(addr).As4()})
+			}
+		}
+		return b.Finish()
+	}
+	return NamedResolver{Name: name, Resolver: &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return &dnsStreamConn{ctx: ctx, exchange: exchange}, nil
+		},
+	}}
+}
+
+func TestCheckPoisoning(t *testing.T) {
+	var (
+		public    = fakeResolver("public", dnsmessage.RCodeSuccess, "93.184.215.14")
+		other     = fakeResolver("other", dnsmessage.RCodeSuccess, "93.184.215.15")
+		injected  = fakeResolver("injected", dnsmessage.RCodeSuccess, "10.10.34.35")
+		private   = fakeResolver("private", dnsmessage.RCodeSuccess, "10.0.0.1")
+		timeout   = fakeResolver("timeout", dnsmessage.RCodeSuccess)
+		servfail  = fakeResolver("servfail", dnsmessage.RCodeServerFailure)
+		nxdomain  = fakeResolver("nxdomain", dnsmessage.RCodeNameError)
+		trustedOK = []NamedResolver{public}
+	)
+	for _, tc := range []struct {
+		name    string
+		primary NamedResolver
+		trusted []NamedResolver
+		want    string
+	}{
+		{"same answer", public, trustedOK, "consistent"},
+		{"another answer", other, trustedOK, "differs"},
+		{"known injected address", injected, trustedOK, "poisoned"},
+		{"private address the trusted resolvers agree on", private, []NamedResolver{private}, "consistent"},
+		{"timeout", timeout, trustedOK, "inconclusive"},
+		{"SERVFAIL", servfail, trustedOK, "inconclusive"},
+		{"no such host", nxdomain, trustedOK, "blocked"},
+		{"trusted resolvers time out", public, []NamedResolver{timeout}, "inconclusive"},
+		{"trusted resolvers time out, known injected address", injected, []NamedResolver{timeout}, "poisoned"},
+		{"both time out", timeout, []NamedResolver{timeout}, "inconclusive"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pc := checkPoisoning(context.Background(), "example.com.", true, false, tc.primary, tc.trusted)
+			if pc.Verdict != tc.want {
+				t.Errorf("Verdict = %q, want %q (primary %v, error %v)", pc.Verdict, tc.want, pc.Primary.Addrs(), pc.Primary.Err)
+			}
+		})
+	}
+}
@@ -0,0 +1,395 @@
+package probe
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// Proxy is an upstream SOCKS5 or HTTP proxy the tests go through.
+type Proxy struct {
+	url *url.URL
+}
+
+// NewProxy parses a socks5:// or http:// proxy URL. Credentials go
+// in the user info part.
+func NewProxy(spec string) (*Proxy, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy %q: %w", spec, err)
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		u.Host = withDefaultPort(u.Host, "1080")
+	case "http":
+		u.Host = withDefaultPort(u.Host, "8080")
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q, use socks5:// or http://", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid proxy %q: missing host", spec)
+	}
+	return &Proxy{url: u}, nil
+}
+
+// String returns the proxy URL without the password.
+func (p *Proxy) String() string {
+	return p.url.Redacted()
+}
+
+func (p *Proxy) isSOCKS() bool {
+	return p.url.Scheme != "http"
+}
+
+// dial connects to the proxy and, for SOCKS5, authenticates. The time it
+// takes is what is reported as the proxy connect time.
+func (p *Proxy) dial(ctx context.Context, d *net.Dialer) (net.Conn, error) {
+	conn, err := d.DialContext(ctx, "tcp", p.url.Host)
+	if err != nil {
+		return nil, err
+	}
+	if !p.isSOCKS() {
+		return conn, nil
+	}
+
+	stop := deadlineFromContext(ctx, conn)
+	defer stop()
+	if err := p.socksAuth(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// connect asks the proxy to open a tunnel to dst over conn.
+func (p *Proxy) connect(ctx context.Context, conn net.Conn, dst netip.AddrPort) (net.Conn, error) {
+	stop := deadlineFromContext(ctx, conn)
+	defer stop()
+
+	if p.isSOCKS() {
+		_, err := socksRequest(conn, socksCmdConnect, dst)
+		return conn, err
+	}
+	return p.httpConnect(conn, dst)
+}
+
+// deadlineFromContext applies the deadline of ctx to conn until the returned
+// function is called.
+func deadlineFromContext(ctx context.Context, conn net.Conn) func() {
+	if dl, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(dl)
+	}
+	return func() { conn.SetDeadline(time.Time{}) }
+}
+
+func (p *Proxy) httpConnect(conn net.Conn, dst netip.AddrPort) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: dst.String()},
+		Host:   dst.String(),
+		Header: make(http.Header),
+	}
+	if u := p.url.User; u != nil {
+		password, _ := u.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(u.Username()+":"+password)))
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	// The body of a successful response is the tunnel, so it is only
+	// closed on failure.
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("proxy CONNECT to %s failed: %s", dst, resp.Status)
+	}
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a conn whose first bytes were already read into r.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+const (
+	socksVersion         = 5
+	socksCmdConnect      = 1
+	socksCmdUDPAssociate = 3
+	socksAuthNone        = 0
+	socksAuthPassword    = 2
+	socksAuthNoMethod    = 0xff
+	socksAtypIPv4        = 1
+	socksAtypDomain      = 3
+	socksAtypIPv6        = 4
+)
+
+// socksReplyErrors maps SOCKS5 reply codes to errors. Where there is a
+// matching errno it is used, so failures classify as if the connection had
+// been made directly.
+var socksReplyErrors = map[byte]error{
+	1: errors.New("general SOCKS server failure"),
+	2: errors.New("connection not allowed by ruleset"),
+	3: syscall.ENETUNREACH,
+	4: syscall.EHOSTUNREACH,
+	5: syscall.ECONNREFUSED,
+	6: syscall.ETIMEDOUT,
+	7: errors.New("command not supported"),
+	8: errors.New("address type not supported"),
+}
+
+// socksAuth negotiates the authentication method and authenticates
+// (RFC 1928 and RFC 1929).
+func (p *Proxy) socksAuth(conn net.Conn) error {
+	methods := []byte{socksAuthNone}
+	if p.url.User != nil {
+		methods = append(methods, socksAuthPassword)
+	}
+	if _, err := conn.Write(append([]byte{socksVersion, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[0] != socksVersion {
+		return fmt.Errorf("socks5: unexpected version %d", reply[0])
+	}
+
+	switch reply[1] {
+	case socksAuthNone:
+		return nil
+	case socksAuthPassword:
+		if p.url.User == nil {
+			return errors.New("socks5: proxy requires authentication")
+		}
+		user := p.url.User.Username()
+		password, _ := p.url.User.Password()
+		if len(user) > 255 || len(password) > 255 {
+			return errors.New("socks5: username or password too long")
+		}
+		msg := []byte{1, byte(len(user))}
+		msg = append(msg, user...)
+		msg = append(msg, byte(len(password)))
+		msg = append(msg, password...)
+		if _, err := conn.Write(msg); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply[:]); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return errors.New("socks5: authentication failed")
+		}
+		return nil
+	default:
+		return errors.New("socks5: no acceptable authentication method")
+	}
+}
+
+// appendSOCKSAddr appends the ATYP, address and port of addr.
+func appendSOCKSAddr(b []byte, addr netip.AddrPort) []byte {
+	ip := addr.Addr().Unmap()
+	if ip.Is4() {
+		b = append(b, socksAtypIPv4)
+	} else {
+		b = append(b, socksAtypIPv6)
+	}
+	b = append(b, ip.AsSlice()...)
+	return binary.BigEndian.AppendUint16(b, addr.Port())
+}
+
+// readSOCKSAddr reads an ATYP, address and port. Domain names are not
+// resolved, an unspecified address is returned for them.
+func readSOCKSAddr(r io.Reader) (netip.AddrPort, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return netip.AddrPort{}, err
+	}
+	var n int
+	switch atyp[0] {
+	case socksAtypIPv4:
+		n = 4
+	case socksAtypIPv6:
+		n = 16
+	case socksAtypDomain:
+		var l [1]byte
+		if _, err := io.ReadFull(r, l[:]); err != nil {
+			return netip.AddrPort{}, err
+		}
+		n = int(l[0])
+	default:
+		return netip.AddrPort{}, fmt.Errorf("socks5: unknown address type %d", atyp[0])
+	}
+
+	buf := make([]byte, n+2)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return netip.AddrPort{}, err
+	}
+	port := binary.BigEndian.Uint16(buf[n:])
+	if atyp[0] == socksAtypDomain {
+		return netip.AddrPortFrom(netip.IPv4Unspecified(), port), nil
+	}
+	addr, _ := netip.AddrFromSlice(buf[:n])
+	return netip.AddrPortFrom(addr, port), nil
+}
+
+// socksRequest sends a request and returns the bound address of the reply.
+func socksRequest(conn net.Conn, cmd byte, dst netip.AddrPort) (netip.AddrPort, error) {
+	req := appendSOCKSAddr([]byte{socksVersion, cmd, 0}, dst)
+	if _, err := conn.Write(req); err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	var reply [3]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return netip.AddrPort{}, err
+	}
+	if reply[0] != socksVersion {
+		return netip.AddrPort{}, fmt.Errorf("socks5: unexpected version %d", reply[0])
+	}
+	if reply[1] != 0 {
+		err, ok := socksReplyErrors[reply[1]]
+		if !ok {
+			err = fmt.Errorf("unknown reply %d", reply[1])
+		}
+		return netip.AddrPort{}, fmt.Errorf("socks5: %w", err)
+	}
+	return readSOCKSAddr(conn)
+}
+
+// associate sets up a SOCKS5 UDP association, for QUIC through the proxy.
+// The UDP socket is bound like the dialer, by src.
+func (p *Proxy) associate(ctx context.Context, d *net.Dialer, src SourceBinding) (*socksPacketConn, error) {
+	if !p.isSOCKS() {
+		return nil, errors.New("UDP is only supported through a SOCKS5 proxy")
+	}
+
+	control, err := p.dial(ctx, d)
+	if err != nil {
+		return nil, err
+	}
+	stop := deadlineFromContext(ctx, control)
+	relay, err := socksRequest(control, socksCmdUDPAssociate, netip.AddrPortFrom(netip.IPv4Unspecified(), 0))
+	stop()
+	if err != nil {
+		control.Close()
+		return nil, err
+	}
+	// Relays listening on all addresses report the unspecified address,
+	// they are reachable on the address of the proxy itself.
+	if relay.Addr().IsUnspecified() {
+		proxyAddr, err := netip.ParseAddrPort(control.RemoteAddr().String())
+		if err != nil {
+			control.Close()
+			return nil, err
+		}
+		relay = netip.AddrPortFrom(proxyAddr.Addr(), relay.Port())
+	}
+
+	udpConn, err := src.listenUDP(ctx, relay.Addr())
+	if err != nil {
+		control.Close()
+		return nil, err
+	}
+
+	return &socksPacketConn{
+		conn:    udpConn,
+		control: control,
+		relay:   net.UDPAddrFromAddrPort(relay),
+		buf:     make([]byte, 0xffff),
+	}, nil
+}
+
+// socksPacketConn sends and receives datagrams through a SOCKS5 UDP relay.
+// It deliberately doesn't expose the methods of *net.UDPConn, so QUIC
+// can't bypass the encapsulation.
+type socksPacketConn struct {
+	conn *net.UDPConn
+	// control is the TCP connection the association lives as long as.
+	control net.Conn
+	relay   *net.UDPAddr
+	buf     []byte
+}
+
+func (c *socksPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, fmt.Errorf("socks5: unsupported address %v", addr)
+	}
+	// RSV(2) FRAG(1) ATYP DST.ADDR DST.PORT DATA
+	msg := appendSOCKSAddr([]byte{0, 0, 0}, udpAddr.AddrPort())
+	if _, err := c.conn.WriteToUDP(append(msg, b...), c.relay); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *socksPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, _, err := c.conn.ReadFromUDP(c.buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		// Fragmented datagrams are dropped, which RFC 1928 allows.
+		if n < 4 || c.buf[2] != 0 {
+			continue
+		}
+		r := &byteReader{b: c.buf[3:n]}
+		src, err := readSOCKSAddr(r)
+		if err != nil {
+			continue
+		}
+		return copy(b, r.b), net.UDPAddrFromAddrPort(src), nil
+	}
+}
+
+func (c *socksPacketConn) Close() error {
+	c.control.Close()
+	return c.conn.Close()
+}
+
+func (c *socksPacketConn) SetReadBuffer(bytes int) error  { return c.conn.SetReadBuffer(bytes) }
+func (c *socksPacketConn) SetWriteBuffer(bytes int) error { return c.conn.SetWriteBuffer(bytes) }
+
+func (c *socksPacketConn) LocalAddr() net.Addr                { return c.conn.LocalAddr() }
+func (c *socksPacketConn) SetDeadline(t time.Time) error      { return c.conn.SetDeadline(t) }
+func (c *socksPacketConn) SetReadDeadline(t time.Time) error  { return c.conn.SetReadDeadline(t) }
+func (c *socksPacketConn) SetWriteDeadline(t time.Time) error { return c.conn.SetWriteDeadline(t) }
+
+// byteReader reads from b, leaving what is left of it in b.
+type byteReader struct {
+	b []byte
+}
+
+func (r *byteReader) Read(p []byte) (int, error) {
+	if len(r.b) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.b)
+	r.b = r.b[n:]
+	return n, nil
+}
@@ -0,0 +1,300 @@
+package probe
+
+import (
+	"cmp"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net"
+	"slices"
+	"sync"
+)
+
+// quicV1InitialSalt derives the Initial packet keys of QUIC version 1 (RFC
+// 9001, section 5.2).
+var quicV1InitialSalt = []byte{
+	0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17,
+	0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a,
+}
+
+// hkdfExpandLabel is HKDF-Expand-Label of TLS 1.3 with an empty context.
+func hkdfExpandLabel(secret []byte, label string, length int) ([]byte, error) {
+	label = "tls13 " + label
+	info := []byte{byte(length >> 8), byte(length), byte(len(label))}
+	info = append(info, label...)
+	info = append(info, 0)
+	return hkdf.Expand(sha256.New, secret, string(info), length)
+}
+
+// quicInitialKeys protect the Initial packets a client sends.
+type quicInitialKeys struct {
+	aead cipher.AEAD
+	iv   []byte
+	hp   cipher.Block
+}
+
+func newQUICInitialKeys(dcid []byte) (*quicInitialKeys, error) {
+	initial, err := hkdf.Extract(sha256.New, dcid, quicV1InitialSalt)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := hkdfExpandLabel(initial, "client in", 32)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hkdfExpandLabel(secret, "quic key", 16)
+	if err != nil {
+		return nil, err
+	}
+	iv, err := hkdfExpandLabel(secret, "quic iv", 12)
+	if err != nil {
+		return nil, err
+	}
+	hpKey, err := hkdfExpandLabel(secret, "quic hp", 16)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	hp, err := aes.NewCipher(hpKey)
+	if err != nil {
+		return nil, err
+	}
+	return &quicInitialKeys{aead: aead, iv: iv, hp: hp}, nil
+}
+
+// readVector reads a vector with a length prefix of size bytes.
+func readVector(data []byte, size int) (vec, rest []byte, ok bool) {
+	if len(data) < size {
+		return nil, nil, false
+	}
+	var n int
+	for _, b := range data[:size] {
+		n = n<<8 | int(b)
+	}
+	if len(data) < size+n {
+		return nil, nil, false
+	}
+	return data[size : size+n], data[size+n:], true
+}
+
+// readVarint reads a QUIC variable-length integer.
+func readVarint(b []byte) (uint64, []byte, bool) {
+	if len(b) == 0 {
+		return 0, nil, false
+	}
+	n := 1 << (b[0] >> 6)
+	if len(b) < n {
+		return 0, nil, false
+	}
+	v := uint64(b[0] & 0x3f)
+	for _, c := range b[1:n] {
+		v = v<<8 | uint64(c)
+	}
+	return v, b[n:], true
+}
+
+// quicCryptoFrame is the data of a CRYPTO frame at its offset in the stream.
+type quicCryptoFrame struct {
+	offset uint64
+	data   []byte
+}
+
+// initialRecorder reassembles the ClientHello from the CRYPTO frames of the
+// QUIC Initial packets written to the connection.
+type initialRecorder struct {
+	net.PacketConn
+
+	mu     sync.Mutex
+	keys   *quicInitialKeys
+	frames []quicCryptoFrame
+	hello  []byte
+	err    error
+}
+
+func (c *initialRecorder) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	if c.hello == nil && c.err == nil {
+		c.err = c.record(b)
+	}
+	c.mu.Unlock()
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+// record reads the Initial packets coalesced in a datagram.
+func (c *initialRecorder) record(datagram []byte) error {
+	errMalformed := errors.New("malformed QUIC packet")
+	for len(datagram) > 0 && datagram[0]&0x80 != 0 {
+		if len(datagram) < 6 {
+			return errMalformed
+		}
+		version := binary.BigEndian.Uint32(datagram[1:])
+		if version != 1 {
+			return errors.New("only QUIC version 1 Initial packets can be read")
+		}
+		packetType := datagram[0] >> 4 & 0x3
+		dcid, rest, ok := readVector(datagram[5:], 1)
+		if !ok {
+			return errMalformed
+		}
+		if _, rest, ok = readVector(rest, 1); !ok { // source connection ID
+			return errMalformed
+		}
+		if packetType == 0 {
+			var tokenLen uint64
+			if tokenLen, rest, ok = readVarint(rest); !ok || uint64(len(rest)) < tokenLen {
+				return errMalformed
+			}
+			rest = rest[tokenLen:]
+		}
+		length, rest, ok := readVarint(rest)
+		if !ok || uint64(len(rest)) < length {
+			return errMalformed
+		}
+		pnOffset := len(datagram) - len(rest)
+		packet := datagram[:pnOffset+int(length)]
+		datagram = datagram[len(packet):]
+		if packetType != 0 {
+			continue
+		}
+
+		// Every Initial of the client is protected with the keys of the
+		// destination connection ID of its first one.
+		if c.keys == nil {
+			keys, err := newQUICInitialKeys(dcid)
+			if err != nil {
+				return err
+			}
+			c.keys = keys
+		}
+		payload, err := c.keys.open(packet, pnOffset)
+		if err != nil {
+			return err
+		}
+		if err := c.readFrames(payload); err != nil {
+			return err
+		}
+		if c.hello != nil {
+			return nil
+		}
+	}
+	return nil
+}
+
+// open removes the header protection of an Initial packet and decrypts its
+// payload.
+func (k *quicInitialKeys) open(packet []byte, pnOffset int) ([]byte, error) {
+	if len(packet) < pnOffset+4+16 {
+		return nil, errors.New("QUIC packet too short")
+	}
+	header := slices.Clone(packet[:pnOffset+4])
+	mask := make([]byte, aes.BlockSize)
+	k.hp.Encrypt(mask, packet[pnOffset+4:pnOffset+4+16])
+	header[0] ^= mask[0] & 0x0f
+	pnLen := int(header[0]&0x3) + 1
+	header = header[:pnOffset+pnLen]
+	var pn uint64
+	for i := range pnLen {
+		header[pnOffset+i] ^= mask[1+i]
+		pn = pn<<8 | uint64(header[pnOffset+i])
+	}
+
+	nonce := slices.Clone(k.iv)
+	for i := range 8 {
+		nonce[len(nonce)-1-i] ^= byte(pn >> (8 * i))
+	}
+	return k.aead.Open(nil, nonce, packet[pnOffset+pnLen:], header)
+}
+
+// readFrames keeps the CRYPTO frames of a decrypted payload, and the
+// ClientHello once they hold all of it.
+func (c *initialRecorder) readFrames(payload []byte) error {
+	errMalformed := errors.New("malformed QUIC frame")
+	for len(payload) > 0 {
+		frameType, rest, ok := readVarint(payload)
+		if !ok {
+			return errMalformed
+		}
+		switch frameType {
+		case 0x00, 0x01: // PADDING, PING
+		case 0x02, 0x03: // ACK
+			// Largest Acknowledged, ACK Delay, ACK Range Count and
+			// First ACK Range, then the ranges and the ECN counts.
+			var ranges uint64
+			for i := range 4 {
+				var v uint64
+				if v, rest, ok = readVarint(rest); !ok {
+					return errMalformed
+				}
+				if i == 2 {
+					ranges = v
+				}
+			}
+			n := 2 * ranges
+			if frameType == 0x03 {
+				n += 3
+			}
+			for range n {
+				if _, rest, ok = readVarint(rest); !ok {
+					return errMalformed
+				}
+			}
+		case 0x06: // CRYPTO
+			var offset, length uint64
+			if offset, rest, ok = readVarint(rest); !ok {
+				return errMalformed
+			}
+			if length, rest, ok = readVarint(rest); !ok || uint64(len(rest)) < length {
+				return errMalformed
+			}
+			c.frames = append(c.frames, quicCryptoFrame{offset: offset, data: slices.Clone(rest[:length])})
+			rest = rest[length:]
+		default:
+			// Nothing else comes before the ClientHello is sent, and
+			// frames can't be skipped without knowing their type.
+			rest = nil
+		}
+		payload = rest
+	}
+
+	slices.SortFunc(c.frames, func(a, b quicCryptoFrame) int { return cmp.Compare(a.offset, b.offset) })
+	var stream []byte
+	for _, f := range c.frames {
+		if f.offset > uint64(len(stream)) {
+			break
+		}
+		if end := f.offset + uint64(len(f.data)); end > uint64(len(stream)) {
+			stream = append(stream, f.data[uint64(len(stream))-f.offset:]...)
+		}
+	}
+	if len(stream) >= 4 {
+		if n := 4 + (int(stream[1])<<16 | int(stream[2])<<8 | int(stream[3])); len(stream) >= n {
+			c.hello = stream[:n]
+			c.frames = nil
+		}
+	}
+	return nil
+}
+
+// fingerprint returns the fingerprint of the reassembled ClientHello.
+func (c *initialRecorder) fingerprint() (*HelloFingerprint, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case c.err != nil:
+		return nil, c.err
+	case c.hello == nil:
+		return nil, errors.New("no complete ClientHello was sent")
+	}
+	return FingerprintHello(TransportQUIC, c.hello)
+}
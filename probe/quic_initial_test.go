@@ -0,0 +1,196 @@
+package probe
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"strings"
+	"testing"
+)
+
+// The client Initial of RFC 9001, appendix A.
+var (
+	rfc9001DCID = unhex("8394c8f03e515708")
+
+	rfc9001Key = unhex("1f369613dd76d5467730efcbe3b1a22d")
+	rfc9001IV  = unhex("fa044b2f42a3fd3b46fb255c")
+	rfc9001HP  = unhex("9f50449e04a0e810283a1e9933adedd2")
+
+	// The ClientHello in the CRYPTO frame of the packet.
+	rfc9001ClientHello = unhex(`
+		010000ed0303ebf8fa56f12939b9584a3896472ec40bb863cfd3e86804fe3a47
+		f06a2b69484c00000413011302010000c000000010000e00000b6578616d706c
+		652e636f6dff01000100000a00080006001d0017001800100007000504616c70
+		6e000500050100000000003300260024001d00209370b2c9caa47fbabaf4559f
+		edba753de171fa71f50f1ce15d43e994ec74d748002b0003020304000d001000
+		0e0403050306030203080408050806002d00020101001c000240010039003204
+		08ffffffffffffffff05048000ffff07048000ffff0801100104800075300901
+		100f088394c8f03e51570806048000ffff`)
+)
+
+func unhex(s string) []byte {
+	b, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestQUICInitialSecrets(t *testing.T) {
+	initial, err := hkdf.Extract(sha256.New, rfc9001DCID, quicV1InitialSalt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := unhex("7db5df06e7a69e432496adedb00851923595221596ae2ae9fb8115c1e9ed0a44"); !bytes.Equal(initial, want) {
+		t.Errorf("initial secret = %x, want %x", initial, want)
+	}
+	secret, err := hkdfExpandLabel(initial, "client in", 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := unhex("c00cf151ca5be075ed0ebfb5c80323c42d6b7db67881289af4008f1f6c357aea"); !bytes.Equal(secret, want) {
+		t.Errorf("client initial secret = %x, want %x", secret, want)
+	}
+	for _, tc := range []struct {
+		label string
+		want  []byte
+	}{
+		{"quic key", rfc9001Key},
+		{"quic iv", rfc9001IV},
+		{"quic hp", rfc9001HP},
+	} {
+		got, err := hkdfExpandLabel(secret, tc.label, len(tc.want))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, tc.want) {
+			t.Errorf("%s = %x, want %x", tc.label, got, tc.want)
+		}
+	}
+}
+
+// protectInitial builds a client Initial packet with a 4 byte packet number
+// and the frames, padded to padTo bytes, and protects it with the keys of
+// RFC 9001, appendix A.
+func protectInitial(t *testing.T, pn uint32, frames []byte, padTo int) []byte {
+	t.Helper()
+	payload := append(bytes.Clone(frames), make([]byte, max(0, padTo-len(frames)))...)
+	length := 4 + len(payload) + 16
+	header := []byte{0xc3, 0, 0, 0, 1, byte(len(rfc9001DCID))}
+	header = append(header, rfc9001DCID...)
+	header = append(header, 0, 0) // source connection ID and token
+	header = append(header, 0x40|byte(length>>8), byte(length))
+	pnOffset := len(header)
+	header = append(header, byte(pn>>24), byte(pn>>16), byte(pn>>8), byte(pn))
+
+	block, err := aes.NewCipher(rfc9001Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := bytes.Clone(rfc9001IV)
+	for i := range 4 {
+		nonce[len(nonce)-1-i] ^= byte(pn >> (8 * i))
+	}
+	packet := aead.Seal(bytes.Clone(header), nonce, payload, header)
+
+	hp, err := aes.NewCipher(rfc9001HP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mask := make([]byte, aes.BlockSize)
+	hp.Encrypt(mask, packet[pnOffset+4:pnOffset+4+16])
+	packet[0] ^= mask[0] & 0x0f
+	for i := range 4 {
+		packet[pnOffset+i] ^= mask[1+i]
+	}
+	return packet
+}
+
+// cryptoFrame builds a CRYPTO frame with the data at offset, which are
+// both below 16384.
+func cryptoFrame(offset int, data []byte) []byte {
+	frame := []byte{0x06}
+	for _, v := range []int{offset, len(data)} {
+		if v < 64 {
+			frame = append(frame, byte(v))
+		} else {
+			frame = append(frame, 0x40|byte(v>>8), byte(v))
+		}
+	}
+	return append(frame, data...)
+}
+
+// discardPacketConn accepts every write.
+type discardPacketConn struct{ net.PacketConn }
+
+func (discardPacketConn) WriteTo(b []byte, _ net.Addr) (int, error) { return len(b), nil }
+
+func TestInitialRecorderRFC9001(t *testing.T) {
+	packet := protectInitial(t, 2, cryptoFrame(0, rfc9001ClientHello), 1162)
+
+	// The packet is the one of RFC 9001, appendix A.2.
+	if len(packet) != 1200 {
+		t.Fatalf("packet is %d bytes, want 1200", len(packet))
+	}
+	if want := unhex("c000000001088394c8f03e5157080000449e7b9aec34d1b1c98dd7689fb8ec11d242b123dc9b"); !bytes.Equal(packet[:len(want)], want) {
+		t.Fatalf("packet starts with %x, want %x", packet[:len(want)], want)
+	}
+
+	c := &initialRecorder{PacketConn: discardPacketConn{}}
+	if _, err := c.WriteTo(packet, nil); err != nil {
+		t.Fatal(err)
+	}
+	if c.err != nil {
+		t.Fatalf("record: %v", c.err)
+	}
+	if !bytes.Equal(c.hello, rfc9001ClientHello) {
+		t.Fatalf("hello = %x, want the ClientHello of the packet", c.hello)
+	}
+	f, err := c.fingerprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(f.JA4, "q13d0211an_") {
+		t.Errorf("JA4 = %q, want a QUIC TLS 1.3 hello with 2 ciphers, 11 extensions and ALPN \"alpn\"", f.JA4)
+	}
+}
+
+func TestInitialRecorderReassembly(t *testing.T) {
+	hello := rfc9001ClientHello
+	first, third := hello[:100], hello[180:]
+
+	// The end of the hello comes first, coalesced with a packet holding the
+	// start, a PING and an ACK, and the middle comes in a later datagram,
+	// overlapping both.
+	frames := append([]byte{0x01, 0x02, 0x00, 0x00, 0x00, 0x00}, cryptoFrame(0, first)...)
+	datagram := append(protectInitial(t, 0, cryptoFrame(180, third), 0), protectInitial(t, 1, frames, 0)...)
+	c := &initialRecorder{PacketConn: discardPacketConn{}}
+	c.WriteTo(datagram, nil)
+	if c.err != nil || c.hello != nil {
+		t.Fatalf("after the first datagram: hello %x, error %v", c.hello, c.err)
+	}
+	c.WriteTo(protectInitial(t, 2, cryptoFrame(90, hello[90:190]), 0), nil)
+	if c.err != nil {
+		t.Fatalf("record: %v", c.err)
+	}
+	if !bytes.Equal(c.hello, hello) {
+		t.Errorf("hello = %x, want %x", c.hello, hello)
+	}
+
+	// A packet that doesn't decrypt is an error.
+	packet := protectInitial(t, 0, cryptoFrame(0, hello), 0)
+	packet[len(packet)-1] ^= 1
+	c = &initialRecorder{PacketConn: discardPacketConn{}}
+	c.WriteTo(packet, nil)
+	if _, err := c.fingerprint(); err == nil {
+		t.Error("a packet with a bad tag was accepted")
+	}
+}
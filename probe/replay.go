@@ -0,0 +1,185 @@
+package probe
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/markpash/heybabe/bepass/sni"
+	utls "github.com/refraction-networking/utls"
+)
+
+// CapturedHello is a ClientHello as a client sent it.
+type CapturedHello struct {
+	// Record is the ClientHello in a single TLS record, the form the uTLS
+	// fingerprinter takes.
+	Record []byte
+	// ServerName is the SNI the client sent, if any.
+	ServerName string
+}
+
+// ParseClientHello reads the ClientHello at the start of data, either the
+// TLS records a client sent or the bare handshake message.
+func ParseClientHello(data []byte) (CapturedHello, error) {
+	recordVersion := []byte{0x03, 0x01}
+	if len(data) > 0 && data[0] == 0x01 {
+		// A bare handshake message, wrap it in a record to read it like
+		// the rest.
+		data = append([]byte{0x16, 0x03, 0x01, byte(len(data) >> 8), byte(len(data))}, data...)
+	} else if len(data) >= 3 {
+		recordVersion = data[1:3]
+	}
+
+	msg, err := sni.ReadClientHello(bytes.NewReader(data))
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return CapturedHello{}, errors.New("truncated ClientHello")
+	}
+	if err != nil {
+		return CapturedHello{}, fmt.Errorf("no ClientHello found: %w", err)
+	}
+
+	// The handshake message may have spanned several records, the
+	// fingerprinter only reads one.
+	record := make([]byte, 0, 5+len(msg.Raw))
+	record = append(record, 0x16, recordVersion[0], recordVersion[1], byte(len(msg.Raw)>>8), byte(len(msg.Raw)))
+	record = append(record, msg.Raw...)
+	return CapturedHello{Record: record, ServerName: msg.ServerName}, nil
+}
+
+// tcpStream is the client side of a TCP connection in a capture.
+type tcpStream struct {
+	first    int
+	segments []tcpSegment
+}
+
+type tcpSegment struct {
+	seq     uint32
+	payload []byte
+}
+
+// data returns the payload of the stream in sequence order from its first
+// captured segment, dropping retransmissions and stopping at the first gap.
+func (s *tcpStream) data() []byte {
+	start := s.segments[0].seq
+	slices.SortStableFunc(s.segments, func(a, b tcpSegment) int {
+		return cmp.Compare(a.seq-start, b.seq-start)
+	})
+	var data []byte
+	next := start
+	for _, seg := range s.segments {
+		offset := next - seg.seq
+		switch {
+		case int32(offset) < 0:
+			return data
+		case int(offset) >= len(seg.payload):
+			continue
+		}
+		data = append(data, seg.payload[offset:]...)
+		next += uint32(len(seg.payload)) - offset
+	}
+	return data
+}
+
+// ReadCaptureHellos returns the ClientHellos at the start of the TCP
+// connections of a pcap or pcapng capture, in the order the connections
+// started. Connections captured after their first bytes are skipped.
+func ReadCaptureHellos(r io.Reader) ([]CapturedHello, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(4)
+	if err != nil {
+		return nil, fmt.Errorf("not a capture: %w", err)
+	}
+
+	var (
+		src      gopacket.PacketDataSource
+		linkType func(gopacket.CaptureInfo) layers.LinkType
+	)
+	if bytes.Equal(magic, []byte{0x0a, 0x0d, 0x0d, 0x0a}) {
+		ng, err := pcapgo.NewNgReader(br, pcapgo.DefaultNgReaderOptions)
+		if err != nil {
+			return nil, err
+		}
+		src = ng
+		linkType = func(ci gopacket.CaptureInfo) layers.LinkType {
+			iface, err := ng.Interface(ci.InterfaceIndex)
+			if err != nil {
+				return ng.LinkType()
+			}
+			return iface.LinkType
+		}
+	} else {
+		pr, err := pcapgo.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		src = pr
+		linkType = func(gopacket.CaptureInfo) layers.LinkType { return pr.LinkType() }
+	}
+
+	streams := make(map[[2]gopacket.Flow]*tcpStream)
+	for {
+		data, ci, err := src.ReadPacketData()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		packet := gopacket.NewPacket(data, linkType(ci), gopacket.Default)
+		tcp, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+		if !ok || packet.NetworkLayer() == nil || len(tcp.Payload) == 0 {
+			continue
+		}
+		key := [2]gopacket.Flow{packet.NetworkLayer().NetworkFlow(), tcp.TransportFlow()}
+		s, ok := streams[key]
+		if !ok {
+			s = &tcpStream{first: len(streams)}
+			streams[key] = s
+		}
+		s.segments = append(s.segments, tcpSegment{seq: tcp.Seq, payload: slices.Clone(tcp.Payload)})
+	}
+
+	ordered := slices.SortedFunc(maps.Values(streams), func(a, b *tcpStream) int { return cmp.Compare(a.first, b.first) })
+	var hellos []CapturedHello
+	for _, s := range ordered {
+		data := s.data()
+		if len(data) < 6 || data[0] != 0x16 || data[5] != 0x01 {
+			continue
+		}
+		if hello, err := ParseClientHello(data); err == nil {
+			hellos = append(hellos, hello)
+		}
+	}
+	return hellos, nil
+}
+
+func fingerprintHello(record []byte) (*utls.ClientHelloSpec, error) {
+	f := &utls.Fingerprinter{AllowBluntMimicry: true}
+	return f.FingerprintClientHello(record)
+}
+
+// NewReplaySpec returns a TCP test sending hello as rebuilt by the uTLS
+// fingerprinter, with the SNI of the target instead of the captured one.
+// Extensions uTLS doesn't know are sent as they were captured.
+func NewReplaySpec(label string, hello CapturedHello) (TestSpec, error) {
+	build, err := perAttemptSpec(func() (*utls.ClientHelloSpec, error) { return fingerprintHello(hello.Record) })
+	if err != nil {
+		return TestSpec{}, fmt.Errorf("failed to fingerprint ClientHello: %w", err)
+	}
+	return TestSpec{
+		Label:           label,
+		Transport:       TransportTCP,
+		Library:         LibraryUTLS,
+		ClientHelloID:   utls.HelloCustom,
+		ClientHelloSpec: build,
+	}, nil
+}
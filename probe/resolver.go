@@ -0,0 +1,263 @@
+package probe
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	quic "github.com/refraction-networking/uquic"
+	utls "github.com/refraction-networking/utls"
+)
+
+// NewResolver builds a resolver from a --resolver value. The empty string
+// is the system resolver, otherwise one of:
+//
+//	udp://1.1.1.1[:53]
+//	tcp://1.1.1.1[:53]
+//	tls://1.1.1.1[:853]              (DNS over TLS)
+//	https://1.1.1.1/dns-query        (DNS over HTTPS)
+//	quic://dns.adguard-dns.com[:853] (DNS over QUIC)
+//
+// Every kind is plugged into the Dial hook of a pure Go net.Resolver, so the
+// result can be used anywhere a *net.Resolver is accepted.
+func NewResolver(spec string) (*net.Resolver, error) {
+	if spec == "" {
+		return &net.Resolver{PreferGo: true}, nil
+	}
+
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid resolver %q: %w", spec, err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid resolver %q: missing host", spec)
+	}
+
+	var dial func(ctx context.Context, network, address string) (net.Conn, error)
+	switch u.Scheme {
+	case "udp", "tcp":
+		server := withDefaultPort(u.Host, "53")
+		dial = func(ctx context.Context, network, _ string) (net.Conn, error) {
+			// A udp:// resolver still retries over TCP when an answer is
+			// truncated.
+			if u.Scheme == "tcp" {
+				network = "tcp"
+			}
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		}
+	case "tls":
+		server := withDefaultPort(u.Host, "853")
+		dial = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			d := tls.Dialer{Config: &tls.Config{ServerName: u.Hostname()}}
+			return d.DialContext(ctx, "tcp", server)
+		}
+	case "https":
+		doh := &dohClient{url: u.String(), client: &http.Client{}}
+		dial = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return &dnsStreamConn{ctx: ctx, exchange: doh.exchange}, nil
+		}
+	case "quic":
+		doq := &doqClient{server: withDefaultPort(u.Host, "853"), serverName: u.Hostname()}
+		dial = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return &dnsStreamConn{ctx: ctx, exchange: doq.exchange}, nil
+		}
+	default:
+		return nil, fmt.Errorf("invalid resolver %q: unsupported scheme %q", spec, u.Scheme)
+	}
+
+	return &net.Resolver{PreferGo: true, Dial: dial}, nil
+}
+
+func withDefaultPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// dnsExchangeFunc sends a single DNS message and returns the response.
+type dnsExchangeFunc func(ctx context.Context, msg []byte) ([]byte, error)
+
+// dnsStreamConn presents a message based transport (DoH, DoQ) as the stream
+// connection the Go resolver expects. Both directions use the two byte
+// length prefix of DNS over TCP.
+type dnsStreamConn struct {
+	ctx      context.Context
+	exchange dnsExchangeFunc
+
+	mu       sync.Mutex
+	wbuf     bytes.Buffer
+	rbuf     bytes.Buffer
+	deadline time.Time
+}
+
+// Write buffers the query, and once a full message is in, exchanges it.
+func (c *dnsStreamConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.wbuf.Write(b)
+	for c.wbuf.Len() >= 2 {
+		n := int(binary.BigEndian.Uint16(c.wbuf.Bytes()))
+		if c.wbuf.Len() < 2+n {
+			break
+		}
+		c.wbuf.Next(2)
+		msg := bytes.Clone(c.wbuf.Next(n))
+
+		ctx := c.ctx
+		if !c.deadline.IsZero() {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithDeadline(ctx, c.deadline)
+			defer cancel()
+		}
+
+		resp, err := c.exchange(ctx, msg)
+		if err != nil {
+			return 0, err
+		}
+		if len(resp) > 0xffff {
+			return 0, errors.New("dns response too large")
+		}
+		c.rbuf.Write(binary.BigEndian.AppendUint16(nil, uint16(len(resp))))
+		c.rbuf.Write(resp)
+	}
+
+	return len(b), nil
+}
+
+// Read returns the buffered responses.
+func (c *dnsStreamConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.rbuf.Len() == 0 {
+		return 0, io.EOF
+	}
+	return c.rbuf.Read(b)
+}
+
+func (c *dnsStreamConn) Close() error         { return nil }
+func (c *dnsStreamConn) LocalAddr() net.Addr  { return nil }
+func (c *dnsStreamConn) RemoteAddr() net.Addr { return nil }
+
+func (c *dnsStreamConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return nil
+}
+
+func (c *dnsStreamConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *dnsStreamConn) SetWriteDeadline(t time.Time) error { return c.SetDeadline(t) }
+
+// dohClient is a DNS over HTTPS (RFC 8484) client.
+type dohClient struct {
+	url    string
+	client *http.Client
+}
+
+func (c *dohClient) exchange(ctx context.Context, msg []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh server returned %s", resp.Status)
+	}
+
+	return io.ReadAll(io.LimitReader(resp.Body, 0xffff))
+}
+
+// doqClient is a DNS over QUIC (RFC 9250) client. It keeps one connection
+// open and sends each query on its own stream.
+type doqClient struct {
+	server     string
+	serverName string
+
+	mu   sync.Mutex
+	conn quic.Connection
+}
+
+func (c *doqClient) connection(ctx context.Context) (quic.Connection, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn != nil && c.conn.Context().Err() == nil {
+		return c.conn, nil
+	}
+
+	tlsConf := &utls.Config{ServerName: c.serverName, NextProtos: []string{"doq"}}
+	conn, err := quic.DialAddr(ctx, c.server, tlsConf, &quic.Config{})
+	if err != nil {
+		return nil, err
+	}
+	c.conn = conn
+	return conn, nil
+}
+
+func (c *doqClient) exchange(ctx context.Context, msg []byte) ([]byte, error) {
+	if len(msg) < 2 {
+		return nil, errors.New("dns message too short")
+	}
+
+	conn, err := c.connection(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.CancelRead(0)
+	if dl, ok := ctx.Deadline(); ok {
+		stream.SetDeadline(dl)
+	}
+
+	// The message ID must be zero on DoQ, put it back on the response so
+	// the resolver can match it.
+	id := binary.BigEndian.Uint16(msg)
+	query := binary.BigEndian.AppendUint16(nil, uint16(len(msg)))
+	query = append(query, 0, 0)
+	query = append(query, msg[2:]...)
+	if _, err := stream.Write(query); err != nil {
+		return nil, err
+	}
+	// Closing the stream only closes the send direction.
+	stream.Close()
+
+	var n [2]byte
+	if _, err := io.ReadFull(stream, n[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(n[:]))
+	if _, err := io.ReadFull(stream, resp); err != nil {
+		return nil, err
+	}
+	if len(resp) < 2 {
+		return nil, errors.New("dns response too short")
+	}
+	binary.BigEndian.PutUint16(resp, id)
+
+	return resp, nil
+}
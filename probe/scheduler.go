@@ -0,0 +1,125 @@
+package probe
+
+import (
+	"context"
+	"math/rand/v2"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// attemptJob identifies a single attempt: which target, which test, against
+// which of the target's addresses and which repetition.
+type attemptJob struct {
+	target  int
+	test    int
+	addr    int
+	attempt uint
+}
+
+// buildJobs lays out every attempt in execution order. addrs holds the number
+// of addresses of each target. By default all repeats of a test run back to
+// back, with interleave the tests are visited round-robin so that drift over
+// time affects every test equally.
+func buildJobs(addrs []int, tests int, repeat uint, interleave bool) []attemptJob {
+	var jobs []attemptJob
+	if interleave {
+		for i := uint(0); i < repeat; i++ {
+			for t := 0; t < tests; t++ {
+				for tg, n := range addrs {
+					for a := 0; a < n; a++ {
+						jobs = append(jobs, attemptJob{target: tg, test: t, addr: a, attempt: i})
+					}
+				}
+			}
+		}
+		return jobs
+	}
+
+	for tg, n := range addrs {
+		for t := 0; t < tests; t++ {
+			for a := 0; a < n; a++ {
+				for i := uint(0); i < repeat; i++ {
+					jobs = append(jobs, attemptJob{target: tg, test: t, addr: a, attempt: i})
+				}
+			}
+		}
+	}
+	return jobs
+}
+
+// destLimiter spaces out attempts against the same destination so that we
+// don't trip rate limits of middleboxes along the path.
+type destLimiter struct {
+	mu     sync.Mutex
+	next   map[netip.AddrPort]time.Time
+	delay  time.Duration
+	jitter time.Duration
+}
+
+func newDestLimiter(delay, jitter time.Duration) *destLimiter {
+	return &destLimiter{
+		next:   make(map[netip.AddrPort]time.Time),
+		delay:  delay,
+		jitter: jitter,
+	}
+}
+
+// wait blocks until an attempt against dst may start. The start of two
+// attempts against the same destination is at least delay (plus a random
+// amount up to jitter) apart.
+func (d *destLimiter) wait(ctx context.Context, dst netip.AddrPort) error {
+	d.mu.Lock()
+	now := time.Now()
+	at := d.next[dst]
+	if at.Before(now) {
+		at = now
+	}
+	gap := d.delay
+	if d.jitter > 0 {
+		gap += rand.N(d.jitter)
+	}
+	d.next[dst] = at.Add(gap)
+	d.mu.Unlock()
+
+	t := time.NewTimer(time.Until(at))
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// runJobs executes jobs in order with at most concurrency of them in flight.
+// Once ctx is done it stops handing out jobs, and it returns how many it
+// handed out, the rest never ran.
+func runJobs(ctx context.Context, concurrency uint, jobs []attemptJob, fn func(attemptJob)) int {
+	queue := make(chan attemptJob)
+	var wg sync.WaitGroup
+	for range min(concurrency, uint(len(jobs))) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range queue {
+				fn(j)
+			}
+		}()
+	}
+
+	var n int
+	for _, j := range jobs {
+		if ctx.Err() != nil {
+			break
+		}
+		select {
+		case queue <- j:
+			n++
+		case <-ctx.Done():
+		}
+	}
+	close(queue)
+	wg.Wait()
+	return n
+}
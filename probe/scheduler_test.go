@@ -0,0 +1,136 @@
+package probe
+
+import (
+	"context"
+	"log/slog"
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBuildJobs(t *testing.T) {
+	// Two targets, the first with two addresses, two tests and two repeats.
+	addrs := []int{2, 1}
+	job := func(target, test, addr int, attempt uint) attemptJob {
+		return attemptJob{target: target, test: test, addr: addr, attempt: attempt}
+	}
+
+	want := []attemptJob{
+		job(0, 0, 0, 0), job(0, 0, 0, 1), job(0, 0, 1, 0), job(0, 0, 1, 1),
+		job(0, 1, 0, 0), job(0, 1, 0, 1), job(0, 1, 1, 0), job(0, 1, 1, 1),
+		job(1, 0, 0, 0), job(1, 0, 0, 1),
+		job(1, 1, 0, 0), job(1, 1, 0, 1),
+	}
+	if got := buildJobs(addrs, 2, 2, false); !slices.Equal(got, want) {
+		t.Errorf("buildJobs = %v, want %v", got, want)
+	}
+
+	want = []attemptJob{
+		job(0, 0, 0, 0), job(0, 0, 1, 0), job(1, 0, 0, 0),
+		job(0, 1, 0, 0), job(0, 1, 1, 0), job(1, 1, 0, 0),
+		job(0, 0, 0, 1), job(0, 0, 1, 1), job(1, 0, 0, 1),
+		job(0, 1, 0, 1), job(0, 1, 1, 1), job(1, 1, 0, 1),
+	}
+	if got := buildJobs(addrs, 2, 2, true); !slices.Equal(got, want) {
+		t.Errorf("buildJobs with interleave = %v, want %v", got, want)
+	}
+
+	if got := buildJobs([]int{0, 3}, 2, 0, false); len(got) != 0 {
+		t.Errorf("buildJobs without repeats = %v, want none", got)
+	}
+}
+
+func TestRunJobs(t *testing.T) {
+	jobs := buildJobs([]int{3}, 4, 2, true)
+
+	// One at a time, the jobs run in order.
+	var got []attemptJob
+	n := runJobs(context.Background(), 1, jobs, func(j attemptJob) { got = append(got, j) })
+	if n != len(jobs) || !slices.Equal(got, jobs) {
+		t.Errorf("ran %d jobs %v, want %v", n, got, jobs)
+	}
+
+	// No more than concurrency jobs are in flight.
+	var inFlight, peak atomic.Int32
+	n = runJobs(context.Background(), 3, jobs, func(attemptJob) {
+		cur := inFlight.Add(1)
+		for {
+			p := peak.Load()
+			if cur <= p || peak.CompareAndSwap(p, cur) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		inFlight.Add(-1)
+	})
+	if n != len(jobs) || peak.Load() > 3 {
+		t.Errorf("ran %d jobs with %d at once, want %d with at most 3", n, peak.Load(), len(jobs))
+	}
+}
+
+func TestRunJobsCanceled(t *testing.T) {
+	jobs := buildJobs([]int{2}, 5, 10, false)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mu sync.Mutex
+	var ran int
+	n := runJobs(ctx, 2, jobs, func(attemptJob) {
+		mu.Lock()
+		defer mu.Unlock()
+		ran++
+		if ran == 5 {
+			cancel()
+		}
+	})
+	// The jobs handed out before the cancellation got through still run,
+	// at most one per worker.
+	if n != ran {
+		t.Errorf("runJobs handed out %d jobs, %d ran", n, ran)
+	}
+	if n < 5 || n > 5+2 {
+		t.Errorf("ran %d of %d jobs, want 5 and at most one per worker more", n, len(jobs))
+	}
+}
+
+func TestRunCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var calls int
+	to := Options{
+		Targets: []Target{{SNI: "example.com", ManualIP: netip.MustParseAddr("192.0.2.1"), Port: 443}},
+		Tests: []Test{{Label: "test", Func: func(context.Context, *slog.Logger, AttemptParams) AttemptResult {
+			calls++
+			if calls == 2 {
+				cancel()
+			}
+			return AttemptResult{}
+		}}},
+		Repeat:      10,
+		Concurrency: 1,
+		Timeout:     time.Second,
+	}
+	run, err := Run(ctx, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The job handed out as the run was canceled fails, and the ones after
+	// it are left out instead of showing up as empty attempts.
+	attempts := run.Targets[0].Results["test"][0].Attempts
+	if len(attempts) < 2 || len(attempts) > 3 {
+		t.Fatalf("got %d attempts, want 2 or 3", len(attempts))
+	}
+	for i, attempt := range attempts[:2] {
+		if attempt.Err != nil || attempt.StartedAt.IsZero() {
+			t.Errorf("attempt %d: error %v, started at %v, want a run attempt", i, attempt.Err, attempt.StartedAt)
+		}
+	}
+	if len(attempts) == 3 && attempts[2].ErrorClass != ClassCanceled {
+		t.Errorf("attempt 2: class %q, want %q", attempts[2].ErrorClass, ClassCanceled)
+	}
+}
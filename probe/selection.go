@@ -0,0 +1,78 @@
+package probe
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// compileTestPattern turns a --tests/--skip-tests value into a regexp.
+// Patterns wrapped in slashes (/uTLS|QUIC/) are used as regular expressions,
+// anything else is treated as a glob over the whole label. Both are case
+// insensitive.
+func compileTestPattern(pattern string) (*regexp.Regexp, error) {
+	if len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		re, err := regexp.Compile("(?i)" + pattern[1:len(pattern)-1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid test pattern %q: %w", pattern, err)
+		}
+		return re, nil
+	}
+
+	glob := regexp.QuoteMeta(pattern)
+	glob = strings.ReplaceAll(glob, `\*`, ".*")
+	glob = strings.ReplaceAll(glob, `\?`, ".")
+	return regexp.MustCompile("(?i)^" + glob + "$"), nil
+}
+
+func compileTestPatterns(patterns []string) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, len(patterns))
+	for i, p := range patterns {
+		re, err := compileTestPattern(p)
+		if err != nil {
+			return nil, err
+		}
+		res[i] = re
+	}
+	return res, nil
+}
+
+func matchesAny(res []*regexp.Regexp, label string) bool {
+	for _, re := range res {
+		if re.MatchString(label) {
+			return true
+		}
+	}
+	return false
+}
+
+// SelectTests keeps the tests matching any of the include patterns (all tests
+// if there are none) and drops those matching any of the skip patterns. The
+// order of the suite is preserved.
+func SelectTests(suite []Test, include, skip []string) ([]Test, error) {
+	inc, err := compileTestPatterns(include)
+	if err != nil {
+		return nil, err
+	}
+	exc, err := compileTestPatterns(skip)
+	if err != nil {
+		return nil, err
+	}
+
+	selected := make([]Test, 0, len(suite))
+	for _, tc := range suite {
+		if len(inc) > 0 && !matchesAny(inc, tc.Label) {
+			continue
+		}
+		if matchesAny(exc, tc.Label) {
+			continue
+		}
+		selected = append(selected, tc)
+	}
+
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("no tests selected")
+	}
+
+	return selected, nil
+}
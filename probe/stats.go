@@ -0,0 +1,110 @@
+package probe
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"time"
+)
+
+// LatencyStats is the distribution of one phase's duration over the
+// successful attempts of a test.
+type LatencyStats struct {
+	Count  int
+	Min    time.Duration
+	P50    time.Duration
+	P90    time.Duration
+	P99    time.Duration
+	Max    time.Duration
+	Mean   time.Duration
+	StdDev time.Duration
+}
+
+// NewLatencyStats computes the distribution of samples. Percentiles are
+// linearly interpolated between the closest ranks, so they stay meaningful
+// with the handful of samples a --repeat run usually has.
+func NewLatencyStats(samples []time.Duration) LatencyStats {
+	if len(samples) == 0 {
+		return LatencyStats{}
+	}
+	sorted := slices.Clone(samples)
+	slices.Sort(sorted)
+
+	var sum float64
+	for _, s := range sorted {
+		sum += float64(s)
+	}
+	mean := sum / float64(len(sorted))
+
+	var variance float64
+	for _, s := range sorted {
+		variance += (float64(s) - mean) * (float64(s) - mean)
+	}
+	variance /= float64(len(sorted))
+
+	return LatencyStats{
+		Count:  len(sorted),
+		Min:    sorted[0],
+		P50:    percentile(sorted, 50),
+		P90:    percentile(sorted, 90),
+		P99:    percentile(sorted, 99),
+		Max:    sorted[len(sorted)-1],
+		Mean:   time.Duration(mean),
+		StdDev: time.Duration(math.Sqrt(variance)),
+	}
+}
+
+// percentile returns the p-th percentile of sorted samples.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := p / 100 * float64(len(sorted)-1)
+	lo := int(math.Floor(rank))
+	hi := int(math.Ceil(rank))
+	frac := rank - float64(lo)
+	return sorted[lo] + time.Duration(math.Round(frac*float64(sorted[hi]-sorted[lo])))
+}
+
+// String formats the distribution for a table cell.
+func (s LatencyStats) String() string {
+	if s.Count == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f/%.1f/%.1f/%.1f/%.1f ±%.1f",
+		Milliseconds(s.Min), Milliseconds(s.P50), Milliseconds(s.P90), Milliseconds(s.P99), Milliseconds(s.Max), Milliseconds(s.StdDev))
+}
+
+// PhaseStats holds the distribution of every phase of a test.
+type PhaseStats struct {
+	// ProxyConnect is empty unless the tests went through a proxy.
+	ProxyConnect LatencyStats
+	Transport    LatencyStats
+	TLSHandshake LatencyStats
+	TTFB         LatencyStats
+}
+
+// NewPhaseStats computes the distributions over the successful attempts.
+func NewPhaseStats(attempts []AttemptResult) PhaseStats {
+	var proxyConnect, transport, tlsHandshake, ttfb []time.Duration
+	for _, attempt := range attempts {
+		if attempt.Err != nil {
+			continue
+		}
+		if attempt.ProxyConnectDuration > 0 {
+			proxyConnect = append(proxyConnect, attempt.ProxyConnectDuration)
+		}
+		transport = append(transport, attempt.TransportEstablishDuration)
+		tlsHandshake = append(tlsHandshake, attempt.TLSHandshakeDuration)
+		ttfb = append(ttfb, attempt.TTFBDuration)
+	}
+	return PhaseStats{
+		ProxyConnect: NewLatencyStats(proxyConnect),
+		Transport:    NewLatencyStats(transport),
+		TLSHandshake: NewLatencyStats(tlsHandshake),
+		TTFB:         NewLatencyStats(ttfb),
+	}
+}
+
+// Milliseconds converts d to fractional milliseconds, the unit durations are
+// reported in.
+func Milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
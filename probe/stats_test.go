@@ -0,0 +1,62 @@
+package probe
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPercentile(t *testing.T) {
+	msSamples := func(values ...float64) []time.Duration {
+		samples := make([]time.Duration, len(values))
+		for i, v := range values {
+			samples[i] = time.Duration(v * float64(time.Millisecond))
+		}
+		return samples
+	}
+	for _, tc := range []struct {
+		name   string
+		sorted []time.Duration
+		p      float64
+		want   float64
+	}{
+		{"one sample p50", msSamples(5), 50, 5},
+		{"one sample p99", msSamples(5), 99, 5},
+		{"even count p50", msSamples(1, 2, 3, 4), 50, 2.5},
+		{"even count p90", msSamples(1, 2, 3, 4), 90, 3.7},
+		{"even count p0", msSamples(1, 2, 3, 4), 0, 1},
+		{"even count p100", msSamples(1, 2, 3, 4), 100, 4},
+		{"odd count p50", msSamples(1, 2, 10), 50, 2},
+		{"interpolated p25", msSamples(10, 20), 25, 12.5},
+		{"interpolated p99", msSamples(10, 20), 99, 19.9},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := Milliseconds(percentile(tc.sorted, tc.p)); got != tc.want {
+				t.Errorf("percentile = %v ms, want %v ms", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestNewLatencyStats(t *testing.T) {
+	var samples []time.Duration
+	for _, v := range []int{9, 2, 4, 5, 4, 7, 4, 5} {
+		samples = append(samples, time.Duration(v)*time.Millisecond)
+	}
+	got := NewLatencyStats(samples)
+	want := LatencyStats{
+		Count:  8,
+		Min:    2 * time.Millisecond,
+		P50:    4500 * time.Microsecond,
+		P90:    7600 * time.Microsecond,
+		P99:    8860 * time.Microsecond,
+		Max:    9 * time.Millisecond,
+		Mean:   5 * time.Millisecond,
+		StdDev: 2 * time.Millisecond,
+	}
+	if got != want {
+		t.Errorf("NewLatencyStats = %#v, want %#v", got, want)
+	}
+	if got := NewLatencyStats(nil); got != (LatencyStats{}) {
+		t.Errorf("NewLatencyStats of nothing = %+v, want zero", got)
+	}
+}
@@ -0,0 +1,110 @@
+package probe
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Target is a single destination the suite runs against.
+type Target struct {
+	SNI  string
+	Host string
+	// ManualIP is tested instead of resolving the SNI, unless it is the
+	// zero Addr or 0.0.0.0.
+	ManualIP netip.Addr
+	Port     uint16
+}
+
+// HasManualIP reports whether ManualIP is set.
+func (t Target) HasManualIP() bool {
+	return t.ManualIP.IsValid() && t.ManualIP != netip.IPv4Unspecified()
+}
+
+// ParseTarget parses a "sni[,host][,ip][,port]" line. Empty fields take the
+// defaults: host falls back to the SNI, no IP means DNS resolution and no
+// port means defaultPort.
+func ParseTarget(line string, defaultPort uint16) (Target, error) {
+	fields := strings.Split(line, ",")
+	if len(fields) > 4 {
+		return Target{}, fmt.Errorf("too many fields in target %q", line)
+	}
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	for len(fields) < 4 {
+		fields = append(fields, "")
+	}
+
+	t := Target{
+		SNI:      fields[0],
+		Host:     fields[1],
+		ManualIP: netip.IPv4Unspecified(),
+		Port:     defaultPort,
+	}
+	if t.SNI == "" {
+		return Target{}, fmt.Errorf("missing SNI in target %q", line)
+	}
+	if t.Host == "" {
+		t.Host = t.SNI
+	}
+	if fields[2] != "" {
+		addr, err := netip.ParseAddr(fields[2])
+		if err != nil {
+			return Target{}, fmt.Errorf("invalid IP in target %q: %w", line, err)
+		}
+		t.ManualIP = addr.Unmap()
+	}
+	if fields[3] != "" {
+		port, err := strconv.ParseUint(fields[3], 10, 16)
+		if err != nil {
+			return Target{}, fmt.Errorf("invalid port in target %q: %w", line, err)
+		}
+		t.Port = uint16(port)
+	}
+
+	return t, nil
+}
+
+// ParseTargets reads one target per line. Blank lines and lines starting
+// with # are ignored.
+func ParseTargets(r io.Reader, defaultPort uint16) ([]Target, error) {
+	var targets []Target
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		t, err := ParseTarget(line, defaultPort)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		targets = append(targets, t)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return targets, nil
+}
+
+// ReadTargetsFile reads targets from path, or from stdin if path is "-".
+func ReadTargetsFile(path string, defaultPort uint16) ([]Target, error) {
+	if path == "-" {
+		return ParseTargets(os.Stdin, defaultPort)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParseTargets(f, defaultPort)
+}
@@ -0,0 +1,464 @@
+package probe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Options configure a Run. Start from DefaultOptions and set the targets.
+type Options struct {
+	// Logger receives the progress of the run, nil discards it.
+	Logger      *slog.Logger
+	ResolveIPv4 bool
+	ResolveIPv6 bool
+	Targets     []Target
+	Resolver    *net.Resolver
+	// ResolverName is how Resolver is shown in the output.
+	ResolverName string
+	// PoisonCheck compares the answers of Resolver with TrustedResolvers
+	// and tests the addresses returned by all of them.
+	PoisonCheck      bool
+	TrustedResolvers []NamedResolver
+	AllIPs           bool
+	MaxIPs           uint
+	Repeat           uint
+	Tests            []Test
+	Concurrency      uint
+	Delay            time.Duration
+	Jitter           time.Duration
+	Timeout          time.Duration
+	Interleave       bool
+	// ECHConfigList overrides the ECH configuration otherwise looked up in
+	// the HTTPS record of each target.
+	ECHConfigList []byte
+	// Insecure completes handshakes even if the certificate doesn't verify.
+	Insecure bool
+	// Proxy routes every test through an upstream proxy when set.
+	Proxy *Proxy
+	// Source binds the connections of every test to a local address or
+	// interface.
+	Source SourceBinding
+	// OnAttempt is called after every attempt if set. It is called from the
+	// workers, so concurrently when Concurrency is above 1.
+	OnAttempt func(target Target, tc Test, addrPort netip.AddrPort, attempt int, res AttemptResult)
+}
+
+// DefaultOptions returns the options of the command line defaults: every
+// test of the Suite once against both address families with the system
+// resolver, one attempt at a time.
+func DefaultOptions() Options {
+	return Options{
+		ResolveIPv4:  true,
+		ResolveIPv6:  true,
+		Resolver:     &net.Resolver{PreferGo: true},
+		ResolverName: "system",
+		Repeat:       1,
+		Tests:        Suite(),
+		Concurrency:  1,
+		Delay:        2 * time.Second,
+		Timeout:      10 * time.Second,
+	}
+}
+
+// Validate checks the options for values Run can't work with.
+func (to Options) Validate() error {
+	switch {
+	case len(to.Targets) == 0:
+		return errors.New("no targets to test")
+	case len(to.Tests) == 0:
+		return errors.New("no tests selected")
+	case to.Repeat == 0:
+		return errors.New("repeat must be at least 1")
+	case to.Concurrency == 0:
+		return errors.New("concurrency must be at least 1")
+	case to.Timeout <= 0:
+		return errors.New("timeout must be positive")
+	case to.Delay < 0 || to.Jitter < 0:
+		return errors.New("delay and jitter cannot be negative")
+	}
+	// The results of a test are kept by its label.
+	labels := make(map[string]bool, len(to.Tests))
+	for _, tc := range to.Tests {
+		if labels[tc.Label] {
+			return fmt.Errorf("more than one test is named %q", tc.Label)
+		}
+		labels[tc.Label] = true
+	}
+	return nil
+}
+
+// TargetResult holds the results of the suite against a single target, keyed
+// by test label.
+type TargetResult struct {
+	Target      Target
+	Results     map[string][]TestResult
+	PoisonCheck *PoisonCheck
+	// Err is why no test could run against the target.
+	Err error
+
+	echConfigList []byte
+	echConfigErr  error
+}
+
+// TestResult holds the attempts of a test against one address of a target.
+type TestResult struct {
+	AddrPort           netip.AddrPort
+	SNI                string
+	DNSResolveDuration time.Duration
+	DNSSources         []string
+	Attempts           []AttemptResult
+}
+
+// AttemptResult is the outcome of a single attempt of a test.
+type AttemptResult struct {
+	// ProxyConnectDuration is the time to connect to the proxy, when there
+	// is one. TransportEstablishDuration then covers the proxy reaching the
+	// target.
+	ProxyConnectDuration       time.Duration
+	TransportEstablishDuration time.Duration
+	TLSHandshakeDuration       time.Duration
+	TTFBDuration               time.Duration
+	ErrorPhase                 ErrorPhase
+	ErrorClass                 ErrorClass
+	// TLSAlert is the decoded alert the server sent, for ClassTLSAlert.
+	TLSAlert string
+	// StartedAt is when the attempt started.
+	StartedAt time.Time
+	// TLSVersion, CipherSuite and ALPN are what the handshake negotiated.
+	TLSVersion  uint16
+	CipherSuite uint16
+	ALPN        string
+	ECH         *ECHResult
+	// ClientHello fingerprints the ClientHello the attempt sent, nil if it
+	// sent none.
+	ClientHello *HelloFingerprint
+	// Certificates is the chain the server presented, leaf first.
+	Certificates []CertInfo
+	// CertVerifyError is why the chain failed to verify, and
+	// CertInterception what about it suggests a middlebox.
+	CertVerifyError  string
+	CertInterception string
+	// Err is why the attempt failed, nil if it succeeded.
+	Err error
+}
+
+// AttemptParams holds everything a test needs for a single attempt.
+type AttemptParams struct {
+	AddrPort netip.AddrPort
+	SNI      string
+	Host     string
+	Resolver *net.Resolver
+	// ECHConfigList is the target's ECH configuration for ECH tests, or
+	// ECHConfigErr why it couldn't be found.
+	ECHConfigList []byte
+	ECHConfigErr  error
+	Insecure      bool
+	Proxy         *Proxy
+	Source        SourceBinding
+}
+
+// TestFunc runs a single attempt of a test.
+type TestFunc func(context.Context, *slog.Logger, AttemptParams) AttemptResult
+
+// Test is a test of the suite.
+type Test struct {
+	// Label names the test in the results, it must be unique.
+	Label string
+	// Spec describes the ClientHello the test sends. Custom tests may leave
+	// it empty.
+	Spec TestSpec
+	Func TestFunc
+}
+
+// NewTest returns the test for a spec, run by the engine.
+func NewTest(spec TestSpec) Test {
+	return Test{Label: spec.Label, Spec: spec, Func: spec.Run}
+}
+
+var (
+	registryMu sync.Mutex
+	registered []Test
+)
+
+// Register adds a custom test to the Suite, after the built-in tests. It
+// panics if the label is empty or taken, or the test has no Func.
+func Register(t Test) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	taken := slices.ContainsFunc(testMatrix, func(s TestSpec) bool { return s.Label == t.Label }) ||
+		slices.ContainsFunc(registered, func(r Test) bool { return r.Label == t.Label })
+	switch {
+	case t.Label == "":
+		panic("probe: Register of a test without a label")
+	case t.Func == nil:
+		panic("probe: Register of test " + t.Label + " without a Func")
+	case taken:
+		panic("probe: Register called twice for test " + t.Label)
+	}
+	registered = append(registered, t)
+}
+
+// Suite returns every test in the order they run and are shown: the built-in
+// tests, then the registered ones.
+func Suite() []Test {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	suite := make([]Test, 0, len(testMatrix)+len(registered))
+	for _, spec := range testMatrix {
+		suite = append(suite, NewTest(spec))
+	}
+	return append(suite, registered...)
+}
+
+// Report is the outcome of running the suite against every target.
+type Report struct {
+	StartedAt  time.Time
+	FinishedAt time.Time
+	Tests      []Test
+	Targets    []TargetResult
+	// Proxy is the proxy the tests went through, and Source what they were
+	// bound to, both empty if none.
+	Proxy  string
+	Source string
+}
+
+// Labels returns the labels of the tests in the order they were run.
+func (r Report) Labels() []string {
+	labels := make([]string, len(r.Tests))
+	for i, tc := range r.Tests {
+		labels[i] = tc.Label
+	}
+	return labels
+}
+
+// Run runs the tests against every target. The error is set if the options
+// are invalid or none of the targets could be resolved, in which case the
+// report still holds why for each target. Failed attempts are not errors,
+// they are in the report.
+func Run(ctx context.Context, to Options) (Report, error) {
+	if err := to.Validate(); err != nil {
+		return Report{}, err
+	}
+	l := to.Logger
+	if l == nil {
+		l = slog.New(slog.DiscardHandler)
+	}
+
+	run := Report{StartedAt: time.Now(), Tests: to.Tests, Source: to.Source.String()}
+	if to.Proxy != nil {
+		run.Proxy = to.Proxy.String()
+	}
+
+	targetResults := make([]TargetResult, len(to.Targets))
+	targetLoggers := make([]*slog.Logger, len(to.Targets))
+	targetAddrPorts := make([][]netip.AddrPort, len(to.Targets))
+	var resolveErrs []error
+
+	for i, target := range to.Targets {
+		tl := l.With("sni", target.SNI, "port", target.Port)
+		targetLoggers[i] = tl
+		targetResults[i] = TargetResult{Target: target, Results: make(map[string][]TestResult)}
+
+		rt, err := targetAddrs(ctx, tl, target, to)
+		targetResults[i].PoisonCheck = rt.poisonCheck
+		if err != nil {
+			targetResults[i].Err = err
+			resolveErrs = append(resolveErrs, err)
+			continue
+		}
+		targetAddrPorts[i] = rt.addrPorts
+
+		if slices.ContainsFunc(to.Tests, func(tc Test) bool { return tc.Spec.ECH }) {
+			if to.ECHConfigList != nil {
+				targetResults[i].echConfigList = to.ECHConfigList
+			} else {
+				targetResults[i].echConfigList, targetResults[i].echConfigErr = lookupECHConfigList(ctx, to.Resolver, target.SNI, target.Port)
+			}
+		}
+
+		for _, tc := range to.Tests {
+			resultsPerTest := make([]TestResult, len(rt.addrPorts))
+			for x, addrPort := range rt.addrPorts {
+				resultsPerTest[x] = TestResult{
+					AddrPort:           addrPort,
+					SNI:                target.SNI,
+					DNSResolveDuration: rt.dnsDuration,
+					DNSSources:         rt.sources[x],
+					Attempts:           make([]AttemptResult, to.Repeat),
+				}
+			}
+			targetResults[i].Results[tc.Label] = resultsPerTest
+		}
+	}
+
+	if len(resolveErrs) == len(to.Targets) {
+		run.FinishedAt = time.Now()
+		run.Targets = targetResults
+		return run, errors.Join(resolveErrs...)
+	}
+
+	addrCounts := make([]int, len(targetAddrPorts))
+	for i, addrPorts := range targetAddrPorts {
+		addrCounts[i] = len(addrPorts)
+	}
+
+	limiter := newDestLimiter(to.Delay, to.Jitter)
+	jobs := buildJobs(addrCounts, len(to.Tests), to.Repeat, to.Interleave)
+	ran := runJobs(ctx, to.Concurrency, jobs, func(j attemptJob) {
+		target := to.Targets[j.target]
+		tc := to.Tests[j.test]
+		addrPort := targetAddrPorts[j.target][j.addr]
+		attempt := &targetResults[j.target].Results[tc.Label][j.addr].Attempts[j.attempt]
+
+		if err := limiter.wait(ctx, addrPort); err != nil {
+			attempt.SetError(PhaseTransport, err, 0)
+			return
+		}
+
+		// Each individual attempt gets its own timeout
+		testCtx, cancel := context.WithTimeout(ctx, to.Timeout)
+		defer cancel()
+		startedAt := time.Now()
+		*attempt = tc.Func(testCtx, targetLoggers[j.target], AttemptParams{
+			AddrPort: addrPort,
+			SNI:      target.SNI,
+			Host:     target.Host,
+			Resolver: to.Resolver,
+
+			ECHConfigList: targetResults[j.target].echConfigList,
+			ECHConfigErr:  targetResults[j.target].echConfigErr,
+			Insecure:      to.Insecure,
+			Proxy:         to.Proxy,
+			Source:        to.Source,
+		})
+		attempt.StartedAt = startedAt
+		if to.OnAttempt != nil {
+			to.OnAttempt(target, tc, addrPort, int(j.attempt), *attempt)
+		}
+	})
+
+	// A canceled run leaves out the attempts that never ran. Jobs are in
+	// order of repetition, so they are the last ones of their test and
+	// address.
+	for _, j := range jobs[ran:] {
+		testResult := &targetResults[j.target].Results[to.Tests[j.test].Label][j.addr]
+		testResult.Attempts = testResult.Attempts[:min(uint(len(testResult.Attempts)), j.attempt)]
+	}
+
+	run.FinishedAt = time.Now()
+	run.Targets = targetResults
+	return run, nil
+}
+
+// resolvedTarget holds the addresses to test for a target.
+type resolvedTarget struct {
+	addrPorts []netip.AddrPort
+	// sources lists the resolvers that returned each address, it is empty
+	// for a manual IP.
+	sources     [][]string
+	dnsDuration time.Duration
+	poisonCheck *PoisonCheck
+}
+
+func (rt *resolvedTarget) add(addrPort netip.AddrPort, source string) {
+	if i := slices.Index(rt.addrPorts, addrPort); i >= 0 {
+		if !slices.Contains(rt.sources[i], source) {
+			rt.sources[i] = append(rt.sources[i], source)
+		}
+		return
+	}
+	rt.addrPorts = append(rt.addrPorts, addrPort)
+	rt.sources = append(rt.sources, []string{source})
+}
+
+// targetAddrs returns the addresses to test for a target, either the manual
+// IP or the result of resolving the SNI. Unless AllIPs is set only the first
+// address of each family is kept. With PoisonCheck the answers of the trusted
+// resolvers are tested as well.
+func targetAddrs(ctx context.Context, l *slog.Logger, target Target, to Options) (resolvedTarget, error) {
+	rt := resolvedTarget{}
+	if target.HasManualIP() {
+		l.Debug("manual IP specified, proceeding with the provided IP")
+		rt.addrPorts = []netip.AddrPort{netip.AddrPortFrom(target.ManualIP, target.Port)}
+		rt.sources = [][]string{nil}
+		return rt, nil
+	}
+
+	l.Debug("manual IP not specified, attempting DNS resolution")
+
+	limit := 1
+	if to.AllIPs {
+		limit = int(to.MaxIPs)
+	}
+	addAnswer := func(v4, v6 []netip.Addr, source string) {
+		if limit > 0 {
+			v4 = v4[:min(limit, len(v4))]
+			v6 = v6[:min(limit, len(v6))]
+		}
+		for _, addr := range append(v4, v6...) {
+			rt.add(netip.AddrPortFrom(addr, target.Port), source)
+		}
+	}
+
+	// Resolve DNS
+	primary := NamedResolver{Name: to.ResolverName, Resolver: to.Resolver}
+	if to.PoisonCheck {
+		pc := checkPoisoning(ctx, target.SNI, to.ResolveIPv4, to.ResolveIPv6, primary, to.TrustedResolvers)
+		rt.poisonCheck = &pc
+		rt.dnsDuration = pc.Primary.Duration
+		for _, answer := range append([]DNSAnswer{pc.Primary}, pc.Trusted...) {
+			addAnswer(answer.V4, answer.V6, answer.Resolver)
+		}
+		if len(rt.addrPorts) == 0 && pc.Primary.Err != nil {
+			return rt, fmt.Errorf("failed to resolve SNI: %w", pc.Primary.Err)
+		}
+	} else {
+		t0 := time.Now()
+		v4, v6, err := resolve(ctx, to.Resolver, target.SNI, to.ResolveIPv4, to.ResolveIPv6)
+		if err != nil {
+			return rt, fmt.Errorf("failed to resolve SNI: %w", err)
+		}
+		rt.dnsDuration = time.Since(t0)
+		addAnswer(v4, v6, primary.Name)
+	}
+	l.Debug("resolved SNI", "duration", rt.dnsDuration)
+
+	if len(rt.addrPorts) == 0 {
+		return rt, fmt.Errorf("no usable addresses found for %s", target.SNI)
+	}
+
+	return rt, nil
+}
+
+func resolve(ctx context.Context, resolver *net.Resolver, hostname string, getv4, getv6 bool) (v4, v6 []netip.Addr, err error) {
+	addrs, err := resolver.LookupHost(ctx, hostname)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, addr := range addrs {
+		ip, err := netip.ParseAddr(addr)
+		if err != nil {
+			return nil, nil, err
+		}
+		ip = ip.Unmap()
+
+		switch {
+		case ip.Is4() && getv4 && !slices.Contains(v4, ip):
+			v4 = append(v4, ip)
+		case ip.Is6() && getv6 && !slices.Contains(v6, ip):
+			v6 = append(v6, ip)
+		}
+	}
+
+	return v4, v6, nil
+}
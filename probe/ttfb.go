@@ -1,4 +1,4 @@
-package main
+package probe
 
 import (
 	"bufio"
@@ -18,7 +18,10 @@ type connWithState interface {
 	ConnectionState() tls.ConnectionState
 }
 
-func measureTTFB(ctx context.Context, conn net.Conn, host string) (ttfb time.Duration, err error) {
+// MeasureTTFB sends a GET request for host and returns the time until the
+// first byte of the response, over HTTP/2 or HTTP/1.1 depending on the
+// negotiated ALPN. conn is a *tls.Conn or *utls.UConn after the handshake.
+func MeasureTTFB(ctx context.Context, conn net.Conn, host string) (ttfb time.Duration, err error) {
 	dl, ok := ctx.Deadline()
 	if ok {
 		conn.SetDeadline(dl)
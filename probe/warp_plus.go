@@ -1,63 +1,16 @@
-package main
+package probe
 
 import (
-	"context"
 	"io"
-	"log/slog"
-	"net"
-	"net/netip"
-	"runtime"
-	"strings"
-	"time"
-
-	// This is for systems that don't have a good set of roots. (update often)
-	_ "golang.org/x/crypto/x509roots/fallback"
 
 	tls "github.com/refraction-networking/utls"
 )
 
-// test_TCP_TLS_warp_plus_custom is a uTLS connection using:
-// warp-plus settings from from warp-plus v1.2.1
-// NOTE: the version of uTLS used in warp-plus is much older than here.
-func test_TCP_TLS_warp_plus_custom(ctx context.Context, l *slog.Logger, addrPort netip.AddrPort, sni string, host string) TestAttemptResult {
-	counter, _, _, _ := runtime.Caller(0)
-	l = l.With("test", strings.Split(runtime.FuncForPC(counter).Name(), ".")[1], "ip", addrPort.Addr().String())
-
-	res := TestAttemptResult{}
-
-	// Initiate TCP connection
-	tcpDialer := net.Dialer{
-		Timeout:       5 * time.Second,
-		LocalAddr:     nil,
-		FallbackDelay: -1, // disable happy-eyeballs
-		KeepAlive:     15, // default
-		Resolver:      &net.Resolver{PreferGo: true},
-	}
-	tcpDialer.SetMultipathTCP(false)
-
-	t0 := time.Now()
-	tcpConn, err := tcpDialer.DialContext(ctx, "tcp", addrPort.String())
-	if err != nil {
-		l.Error(err.Error())
-		res.err = err
-		return res
-	}
-	defer tcpConn.Close()
-	res.TransportEstablishDuration = time.Since(t0)
-
-	tlsConfig := tls.Config{
-		ServerName:         sni,
-		InsecureSkipVerify: false,
-		CipherSuites:       nil,
-		MinVersion:         tls.VersionTLS10,
-		CurvePreferences:   nil,
-	}
-
-	tlsConn := tls.UClient(tcpConn, &tlsConfig, tls.HelloCustom)
-	defer tlsConn.Close()
-
+// warpPlusClientHelloSpec is the hand-written ClientHello from warp-plus
+// v1.2.1.
+func warpPlusClientHelloSpec(sni string) (*tls.ClientHelloSpec, error) {
 	SNICurveSize := 1200
-	spec := tls.ClientHelloSpec{
+	return &tls.ClientHelloSpec{
 		TLSVersMax: tls.VersionTLS12,
 		TLSVersMin: tls.VersionTLS12,
 		CipherSuites: []uint16{
@@ -103,33 +56,7 @@ func test_TCP_TLS_warp_plus_custom(ctx context.Context, l *slog.Logger, addrPort
 			&tls.SNIExtension{ServerName: sni},
 		},
 		GetSessionID: nil,
-	}
-	if err := tlsConn.ApplyPreset(&spec); err != nil {
-		l.Error(err.Error())
-		res.err = err
-		return res
-	}
-
-	// Explicitly run the handshake
-	t0 = time.Now()
-	if err := tlsConn.HandshakeContext(ctx); err != nil {
-		l.Error(err.Error())
-		res.err = err
-		return res
-	}
-	res.TLSHandshakeDuration = time.Since(t0)
-
-	tlsState := tlsConn.ConnectionState()
-	l.Info("handshake success", "handshake", tlsState.HandshakeComplete)
-
-	ttfb, err := measureTTFB(ctx, tlsConn, host)
-	if err != nil {
-		res.err = err
-		l.Error(err.Error())
-	}
-	res.TTFBDuration = ttfb
-
-	return res
+	}, nil
 }
 
 // Weird extension added in warp-plus that I don't understand (I think
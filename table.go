@@ -0,0 +1,390 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/markpash/heybabe/probe"
+	"github.com/rodaine/table"
+)
+
+// printTable prints the results of a target of the run. withStats adds the
+// latency distribution of each phase next to the averages.
+func printTable(w io.Writer, run probe.Report, tr probe.TargetResult, withStats bool) {
+	order, proxy := run.Labels(), run.Proxy
+	targetFmt := color.New(color.FgHiYellow, color.Bold).SprintfFunc()
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, targetFmt("Target: %s (host %s, port %d)", tr.Target.SNI, tr.Target.Host, tr.Target.Port))
+	if run.Source != "" {
+		fmt.Fprintf(w, "From %s\n", run.Source)
+	}
+	if proxy != "" {
+		fmt.Fprintf(w, "Through proxy %s\n", proxy)
+	}
+	if tr.PoisonCheck != nil {
+		printPoisonCheck(w, *tr.PoisonCheck)
+	}
+	if tr.Err != nil {
+		fmt.Fprintf(w, "  %v\n", tr.Err)
+		return
+	}
+	if testResults := tr.Results[order[0]]; len(testResults) > 0 && testResults[0].DNSResolveDuration > 0 {
+		fmt.Fprintf(w, "DNS resolution: %.1f ms\n", float64(testResults[0].DNSResolveDuration)/float64(time.Millisecond))
+	}
+
+	headerFmt := color.New(color.FgHiMagenta, color.Bold, color.Underline).SprintfFunc()
+	columnFmt := color.New(color.FgHiCyan, color.Bold).SprintfFunc()
+
+	columns := []any{"Method", "SNI", "IP:Port", "Handshake", "Transport", "TLS Handshake", "TTFB", "Failure"}
+	if proxy != "" {
+		columns = slices.Insert(columns, 4, any("Proxy Connect"))
+	}
+	if withStats {
+		if proxy != "" {
+			columns = append(columns, "Proxy Connect min/p50/p90/p99/max ±sd")
+		}
+		columns = append(columns,
+			"Transport min/p50/p90/p99/max ±sd",
+			"TLS Handshake min/p50/p90/p99/max ±sd",
+			"TTFB min/p50/p90/p99/max ±sd",
+		)
+	}
+	tbl := table.New(columns...)
+	tbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt).WithWriter(w)
+
+	formatDur := func(d time.Duration) string {
+		if d == 0 {
+			return "0 ms"
+		}
+		return fmt.Sprintf("%.1f ms", probe.Milliseconds(d))
+	}
+
+	for _, testName := range order {
+		testResults := tr.Results[testName]
+		for _, testResult := range testResults {
+			stats := probe.NewPhaseStats(testResult.Attempts)
+			successCount := stats.Transport.Count
+			totalAttempts := len(testResult.Attempts)
+			status := fmt.Sprintf("%-7s (%d/%d)", resultStatus(successCount, totalAttempts), successCount, totalAttempts)
+
+			addrPort := testResult.AddrPort.String()
+			if tr.PoisonCheck != nil {
+				addrPort += " (" + strings.Join(testResult.DNSSources, ", ") + ")"
+			}
+
+			row := []any{
+				testName,
+				testResult.SNI,
+				addrPort,
+				status,
+				formatDur(stats.Transport.Mean),
+				formatDur(stats.TLSHandshake.Mean),
+				formatDur(stats.TTFB.Mean),
+				dominantFailure(testResult.Attempts),
+			}
+			if proxy != "" {
+				row = slices.Insert(row, 4, any(formatDur(stats.ProxyConnect.Mean)))
+			}
+			if withStats {
+				if proxy != "" {
+					row = append(row, stats.ProxyConnect)
+				}
+				row = append(row, stats.Transport, stats.TLSHandshake, stats.TTFB)
+			}
+			tbl.AddRow(row...)
+		}
+	}
+
+	tbl.Print()
+
+	printECHResults(w, tr, order)
+	printClientHellos(w, tr, order)
+	printCertificates(w, tr, order)
+	printIPDifferences(w, tr, order)
+}
+
+// printECHResults sums up what the ECH tests learned from each address.
+func printECHResults(w io.Writer, tr probe.TargetResult, order []string) {
+	for _, testName := range order {
+		for _, testResult := range tr.Results[testName] {
+			var (
+				offered, accepted, retry int
+				outerSNI                 string
+			)
+			for _, attempt := range testResult.Attempts {
+				if attempt.ECH == nil {
+					continue
+				}
+				offered++
+				outerSNI = attempt.ECH.OuterSNI
+				if attempt.ECH.Accepted {
+					accepted++
+				}
+				if attempt.ECH.RetryConfigs {
+					retry++
+				}
+			}
+			if offered == 0 {
+				continue
+			}
+			fmt.Fprintf(w, "%s on %s: ECH accepted %d/%d, outer SNI %s, retry configs returned %d/%d\n",
+				testName, testResult.AddrPort, accepted, offered, outerSNI, retry, offered)
+		}
+	}
+}
+
+// printClientHellos lists the fingerprints of the ClientHellos each test
+// sent. Shuffled extensions change the JA3 of every attempt but not the JA4,
+// so only the number of JA3 hashes is shown when there are several.
+func printClientHellos(w io.Writer, tr probe.TargetResult, order []string) {
+	headerFmt := color.New(color.FgHiMagenta, color.Bold, color.Underline).SprintfFunc()
+	columnFmt := color.New(color.FgHiCyan, color.Bold).SprintfFunc()
+
+	tbl := table.New("Method", "JA4", "JA3 Hash")
+	tbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt).WithWriter(w)
+	rows := 0
+	for _, testName := range order {
+		var ja4s []string
+		ja3Hashes := make(map[string][]string)
+		for _, testResult := range tr.Results[testName] {
+			for _, attempt := range testResult.Attempts {
+				hello := attempt.ClientHello
+				if hello == nil {
+					continue
+				}
+				if _, ok := ja3Hashes[hello.JA4]; !ok {
+					ja4s = append(ja4s, hello.JA4)
+				}
+				if !slices.Contains(ja3Hashes[hello.JA4], hello.JA3Hash) {
+					ja3Hashes[hello.JA4] = append(ja3Hashes[hello.JA4], hello.JA3Hash)
+				}
+			}
+		}
+		for _, ja4 := range ja4s {
+			ja3Hash := ja3Hashes[ja4][0]
+			if n := len(ja3Hashes[ja4]); n > 1 {
+				ja3Hash = fmt.Sprintf("%d different", n)
+			}
+			tbl.AddRow(testName, ja4, ja3Hash)
+			rows++
+		}
+	}
+	if rows == 0 {
+		return
+	}
+
+	fmt.Fprintln(w, "ClientHellos:")
+	tbl.Print()
+}
+
+// resultStatus sums up how many attempts of a test succeeded.
+func resultStatus(successCount, totalAttempts int) string {
+	switch {
+	case totalAttempts == 0:
+		return "Not run"
+	case successCount == 0:
+		return "Failed"
+	case successCount == totalAttempts:
+		return "Success"
+	default:
+		return "Partial"
+	}
+}
+
+// printIPDifferences lists the tests where the addresses of a target did not
+// all end up with the same status, since blocking is often per IP.
+func printIPDifferences(w io.Writer, tr probe.TargetResult, order []string) {
+	warnFmt := color.New(color.FgHiRed, color.Bold).SprintfFunc()
+
+	printedHeader := false
+	for _, testName := range order {
+		testResults := tr.Results[testName]
+		if len(testResults) < 2 {
+			continue
+		}
+
+		byStatus := make(map[string][]string)
+		var statuses []string
+		for _, testResult := range testResults {
+			successCount := 0
+			for _, attempt := range testResult.Attempts {
+				if attempt.Err == nil {
+					successCount++
+				}
+			}
+			status := resultStatus(successCount, len(testResult.Attempts))
+			if _, ok := byStatus[status]; !ok {
+				statuses = append(statuses, status)
+			}
+			byStatus[status] = append(byStatus[status], testResult.AddrPort.Addr().String())
+		}
+
+		if len(statuses) < 2 {
+			continue
+		}
+
+		if !printedHeader {
+			fmt.Fprintln(w, warnFmt("IPs behaving differently for %s:", tr.Target.SNI))
+			printedHeader = true
+		}
+		fmt.Fprintf(w, "  %s\n", testName)
+		for _, status := range statuses {
+			fmt.Fprintf(w, "    %-7s %s\n", status, strings.Join(byStatus[status], ", "))
+		}
+	}
+}
+
+// dominantFailure returns the most common failure among the attempts, e.g.
+// "reset_after_client_hello (3)", or the empty string if none failed.
+func dominantFailure(attempts []probe.AttemptResult) string {
+	counts := make(map[string]int)
+	for _, attempt := range attempts {
+		if attempt.Err == nil {
+			continue
+		}
+		key := string(attempt.ErrorClass)
+		if attempt.TLSAlert != "" {
+			key += ": " + attempt.TLSAlert
+		}
+		counts[key]++
+	}
+	if len(counts) == 0 {
+		return ""
+	}
+
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+
+	return fmt.Sprintf("%s (%d)", keys[0], counts[keys[0]])
+}
+
+// chainKey identifies a chain by the SPKI hashes of its certificates.
+func chainKey(chain []probe.CertInfo) string {
+	hashes := make([]string, len(chain))
+	for i, c := range chain {
+		hashes[i] = c.SPKISHA256
+	}
+	return strings.Join(hashes, "/")
+}
+
+// printCertificates lists the distinct chains presented for a target and
+// which tests saw them. Different chains for the same SNI, or chains that
+// look like interception, are flagged.
+func printCertificates(w io.Writer, tr probe.TargetResult, order []string) {
+	warnFmt := color.New(color.FgHiRed, color.Bold).SprintfFunc()
+
+	type seenChain struct {
+		chain     []probe.CertInfo
+		verifyErr string
+		hint      string
+		seenBy    []string
+	}
+	var chains []*seenChain
+	byKey := make(map[string]*seenChain)
+
+	for _, testName := range order {
+		for _, testResult := range tr.Results[testName] {
+			seen := make(map[string]bool)
+			for _, attempt := range testResult.Attempts {
+				if len(attempt.Certificates) == 0 {
+					continue
+				}
+				key := chainKey(attempt.Certificates)
+				sc, ok := byKey[key]
+				if !ok {
+					sc = &seenChain{chain: attempt.Certificates, verifyErr: attempt.CertVerifyError, hint: attempt.CertInterception}
+					byKey[key] = sc
+					chains = append(chains, sc)
+				}
+				if !seen[key] {
+					seen[key] = true
+					sc.seenBy = append(sc.seenBy, fmt.Sprintf("%s @ %s", testName, testResult.AddrPort.Addr()))
+				}
+			}
+		}
+	}
+
+	if len(chains) == 0 {
+		return
+	}
+
+	fmt.Fprintln(w, "Certificates:")
+	for i, sc := range chains {
+		leaf := sc.chain[0]
+		fmt.Fprintf(w, "  [%d] %s, issued by %s\n", i+1, leaf.Subject, leaf.Issuer)
+		fmt.Fprintf(w, "      SANs: %s\n", strings.Join(leaf.SANs, ", "))
+		fmt.Fprintf(w, "      valid %s to %s, SPKI sha256/%s, chain of %d\n",
+			leaf.NotBefore.Format(time.DateOnly), leaf.NotAfter.Format(time.DateOnly), leaf.SPKISHA256, len(sc.chain))
+		if sc.verifyErr != "" {
+			fmt.Fprintf(w, "      %s\n", warnFmt("verification failed: %s", sc.verifyErr))
+		}
+		if sc.hint != "" {
+			fmt.Fprintf(w, "      %s\n", warnFmt("possible interception: %s", sc.hint))
+		}
+		fmt.Fprintf(w, "      seen by %d test(s): %s\n", len(sc.seenBy), strings.Join(sc.seenBy, "; "))
+	}
+	if len(chains) > 1 {
+		fmt.Fprintln(w, warnFmt("Different certificate chains were presented for %s", tr.Target.SNI))
+	}
+}
+
+// printPoisonCheck prints the answers of every resolver and the verdict.
+func printPoisonCheck(w io.Writer, pc probe.PoisonCheck) {
+	verdictFmt := color.New(color.FgHiGreen, color.Bold).SprintfFunc()
+	switch pc.Verdict {
+	case "differs", "inconclusive":
+		verdictFmt = color.New(color.FgHiYellow, color.Bold).SprintfFunc()
+	case "blocked", "poisoned":
+		verdictFmt = color.New(color.FgHiRed, color.Bold).SprintfFunc()
+	}
+
+	fmt.Fprintf(w, "DNS poisoning check: %s\n", verdictFmt(pc.Verdict))
+	for _, answer := range append([]probe.DNSAnswer{pc.Primary}, pc.Trusted...) {
+		if answer.Err != nil {
+			fmt.Fprintf(w, "  %-40s error: %v\n", answer.Resolver, answer.Err)
+			continue
+		}
+		addrs := make([]string, 0, len(answer.V4)+len(answer.V6))
+		for _, addr := range answer.Addrs() {
+			if reason, ok := pc.Suspicious[addr]; ok && answer.Resolver == pc.Primary.Resolver {
+				addrs = append(addrs, fmt.Sprintf("%s [%s]", addr, reason))
+				continue
+			}
+			addrs = append(addrs, addr.String())
+		}
+		fmt.Fprintf(w, "  %-40s %s\n", answer.Resolver, strings.Join(addrs, ", "))
+	}
+}
+
+// printTestList prints every test with its transport, TLS stack and
+// fingerprint.
+func printTestList(suite []probe.Test) {
+	headerFmt := color.New(color.FgHiMagenta, color.Bold, color.Underline).SprintfFunc()
+	columnFmt := color.New(color.FgHiCyan, color.Bold).SprintfFunc()
+
+	tbl := table.New("Method", "Transport", "TLS Stack", "Fingerprint", "Fragment")
+	tbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt)
+
+	for _, tc := range suite {
+		fragment := "no"
+		if tc.Spec.Fragment != nil {
+			fragment = "yes"
+		}
+		tbl.AddRow(tc.Label, tc.Spec.Transport, tc.Spec.Library, tc.Spec.Fingerprint(), fragment)
+	}
+
+	tbl.Print()
+}